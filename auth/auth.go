@@ -0,0 +1,194 @@
+package auth
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "errors"
+    "strconv"
+    "sync"
+    "time"
+)
+
+const (
+    //连接建立后客户端发送的第一个包，携带凭证
+    HandshakeMethod = "Auth.Handshake"
+
+    DefaultMaxSkew = 5 * time.Minute
+    //时间窗口内保留的nonce上限，超过时拒绝新的凭证
+    DefaultMaxNonces = 1 << 20
+
+    nonceBuckets = 8 //时间窗口内nonce按过期时间分桶，过期后整桶删除
+)
+
+var (
+    ErrInvalidCredentials = errors.New("invalid credentials")
+    ErrUnknownID          = errors.New("unknown credentials id")
+    ErrBadSignature       = errors.New("signature mismatch")
+    ErrExpired            = errors.New("credentials expired")
+    ErrReplayed           = errors.New("nonce replayed")
+    ErrTooManyNonces      = errors.New("too many nonces in skew window")
+)
+
+//客户端凭证，token或者HMAC签名
+type Credentials struct {
+    ID        string `json:"id"`                  //调用方标识，HMAC时用于查找密钥
+    Token     string `json:"token,omitempty"`     //静态token
+    Timestamp int64  `json:"timestamp,omitempty"` //签名时间，unix秒
+    Nonce     string `json:"nonce,omitempty"`     //随机数，防重放
+    Signature string `json:"signature,omitempty"` //hex(HMAC-SHA256(secret, len(id) id timestamp len(nonce) nonce))
+}
+
+//认证通过后的调用方身份
+type Principal struct {
+    Name  string
+    Roles []string
+}
+
+func (p *Principal) HasRole(role string) bool {
+    for _, r := range p.Roles {
+        if r == role {
+            return true
+        }
+    }
+    return false
+}
+
+//服务端认证凭证，ctx中带有连接对端的信息；返回error时拒绝连接
+type Authenticator func(ctx context.Context, creds *Credentials) (*Principal, error)
+
+//客户端每次建立连接时获取凭证，HMAC凭证每次重新签名
+type CredentialsProvider func() (*Credentials, error)
+
+func Token(id, token string) CredentialsProvider {
+    return func() (*Credentials, error) {
+        return &Credentials{ID: id, Token: token}, nil
+    }
+}
+
+func HMAC(id string, secret []byte) CredentialsProvider {
+    return func() (*Credentials, error) {
+        nonce := make([]byte, 16)
+        if _, err := rand.Read(nonce); err != nil {
+            return nil, err
+        }
+        creds := &Credentials{
+            ID:        id,
+            Timestamp: time.Now().Unix(),
+            Nonce:     hex.EncodeToString(nonce),
+        }
+        creds.Signature = Sign(creds, secret)
+        return creds, nil
+    }
+}
+
+//计算HMAC签名，字段带长度前缀，不同的(id, nonce)组合不会得到相同的签名内容
+func Sign(creds *Credentials, secret []byte) string {
+    mac := hmac.New(sha256.New, secret)
+    var buf [8]byte
+    binary.BigEndian.PutUint32(buf[:4], uint32(len(creds.ID)))
+    mac.Write(buf[:4])
+    mac.Write([]byte(creds.ID))
+    binary.BigEndian.PutUint64(buf[:], uint64(creds.Timestamp))
+    mac.Write(buf[:])
+    binary.BigEndian.PutUint32(buf[:4], uint32(len(creds.Nonce)))
+    mac.Write(buf[:4])
+    mac.Write([]byte(creds.Nonce))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+//服务端校验HMAC凭证：签名、时间偏差，并在时间窗口内拒绝重复的nonce
+type HMACVerifier struct {
+    secrets   func(id string) ([]byte, bool)
+    maxSkew   time.Duration
+    maxNonces int
+
+    lock    sync.Mutex                    //protect following
+    buckets map[int64]map[string]struct{} //过期时间所在的桶 -> nonces
+    count   int                           //所有桶中的nonce数
+}
+
+func NewHMACVerifier(secrets func(id string) ([]byte, bool), maxSkew time.Duration) *HMACVerifier {
+    if maxSkew <= 0 {
+        maxSkew = DefaultMaxSkew
+    }
+    return &HMACVerifier{
+        secrets:   secrets,
+        maxSkew:   maxSkew,
+        maxNonces: DefaultMaxNonces,
+        buckets:   make(map[int64]map[string]struct{}),
+    }
+}
+
+//修改保留的nonce上限，n<=0时使用DefaultMaxNonces
+func (v *HMACVerifier) SetMaxNonces(n int) {
+    if n <= 0 {
+        n = DefaultMaxNonces
+    }
+    v.lock.Lock()
+    v.maxNonces = n
+    v.lock.Unlock()
+}
+
+//桶的时间跨度，时间窗口内最多有2*nonceBuckets+1个桶
+func (v *HMACVerifier) bucketWidth() int64 {
+    width := int64(v.maxSkew) / nonceBuckets
+    if width <= 0 {
+        width = 1
+    }
+    return width
+}
+
+func (v *HMACVerifier) Verify(creds *Credentials) error {
+    return v.verify(creds, time.Now())
+}
+
+func (v *HMACVerifier) verify(creds *Credentials, now time.Time) error {
+    if creds == nil || creds.ID == "" || creds.Nonce == "" || creds.Signature == "" {
+        return ErrInvalidCredentials
+    }
+    secret, ok := v.secrets(creds.ID)
+    if !ok {
+        return ErrUnknownID
+    }
+    if !hmac.Equal([]byte(Sign(creds, secret)), []byte(creds.Signature)) {
+        return ErrBadSignature
+    }
+    ts := time.Unix(creds.Timestamp, 0)
+    if ts.Before(now.Add(-v.maxSkew)) || ts.After(now.Add(v.maxSkew)) {
+        return ErrExpired
+    }
+
+    width := v.bucketWidth()
+    v.lock.Lock()
+    defer v.lock.Unlock()
+    //整桶删除已过期的nonce，桶内最晚的过期时间早于now
+    for b, nonces := range v.buckets {
+        if (b+1)*width <= now.UnixNano() {
+            v.count -= len(nonces)
+            delete(v.buckets, b)
+        }
+    }
+    key := strconv.Itoa(len(creds.ID)) + ":" + creds.ID + creds.Nonce
+    for _, nonces := range v.buckets {
+        if _, exist := nonces[key]; exist {
+            return ErrReplayed
+        }
+    }
+    if v.count >= v.maxNonces {
+        return ErrTooManyNonces
+    }
+    //超出时间偏差的凭证会被拒绝，nonce只需保留到那时
+    b := ts.Add(v.maxSkew).UnixNano() / width
+    nonces, ok := v.buckets[b]
+    if !ok {
+        nonces = make(map[string]struct{})
+        v.buckets[b] = nonces
+    }
+    nonces[key] = struct{}{}
+    v.count++
+    return nil
+}
@@ -0,0 +1,109 @@
+package auth
+
+import (
+    "testing"
+    "time"
+)
+
+func TestHMACVerifier(t *testing.T) {
+    secrets := map[string][]byte{"gm": []byte("secret")}
+    v := NewHMACVerifier(func(id string) ([]byte, bool) {
+        s, ok := secrets[id]
+        return s, ok
+    }, time.Minute)
+
+    creds, err := HMAC("gm", []byte("secret"))()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := v.Verify(creds); err != nil {
+        t.Fatal(err)
+    }
+    //同一凭证不能重复使用
+    if err := v.Verify(creds); err != ErrReplayed {
+        t.Fatalf("replayed credentials: %v", err)
+    }
+    //每次获取重新签名
+    creds2, _ := HMAC("gm", []byte("secret"))()
+    if creds2.Nonce == creds.Nonce {
+        t.Fatal("nonce reused")
+    }
+    if err := v.Verify(creds2); err != nil {
+        t.Fatal(err)
+    }
+
+    bad, _ := HMAC("gm", []byte("wrong"))()
+    if err := v.Verify(bad); err != ErrBadSignature {
+        t.Fatalf("bad signature: %v", err)
+    }
+    unknown, _ := HMAC("player", []byte("secret"))()
+    if err := v.Verify(unknown); err != ErrUnknownID {
+        t.Fatalf("unknown id: %v", err)
+    }
+    old := &Credentials{ID: "gm", Timestamp: time.Now().Add(-2 * time.Minute).Unix(), Nonce: "1"}
+    old.Signature = Sign(old, []byte("secret"))
+    if err := v.Verify(old); err != ErrExpired {
+        t.Fatalf("expired credentials: %v", err)
+    }
+    //篡改签名内容
+    forged := *creds2
+    forged.Nonce = "forged"
+    if err := v.Verify(&forged); err != ErrBadSignature {
+        t.Fatalf("forged credentials: %v", err)
+    }
+    if err := v.Verify(&Credentials{ID: "gm"}); err != ErrInvalidCredentials {
+        t.Fatalf("empty credentials: %v", err)
+    }
+}
+
+//字段中带有分隔符时签名内容不会相同
+func TestSignAmbiguity(t *testing.T) {
+    secret := []byte("secret")
+    a := &Credentials{ID: "gm", Timestamp: 1, Nonce: "2|3"}
+    b := &Credentials{ID: "gm|1", Timestamp: 2, Nonce: "3"}
+    if Sign(a, secret) == Sign(b, secret) {
+        t.Fatal("different credentials share signature")
+    }
+}
+
+//nonce数量有上限，过期后整桶删除
+func TestHMACNonces(t *testing.T) {
+    secret := []byte("secret")
+    v := NewHMACVerifier(func(id string) ([]byte, bool) {
+        return secret, true
+    }, time.Minute)
+    v.SetMaxNonces(2)
+    now := time.Now()
+    newCreds := func(nonce string, ts time.Time) *Credentials {
+        creds := &Credentials{ID: "gm", Timestamp: ts.Unix(), Nonce: nonce}
+        creds.Signature = Sign(creds, secret)
+        return creds
+    }
+    for _, nonce := range []string{"1", "2"} {
+        if err := v.verify(newCreds(nonce, now), now); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := v.verify(newCreds("3", now), now); err != ErrTooManyNonces {
+        t.Fatalf("nonces over limit: %v", err)
+    }
+    if err := v.verify(newCreds("1", now), now); err != ErrReplayed {
+        t.Fatalf("replayed credentials: %v", err)
+    }
+
+    //时间窗口过后旧的nonce被删除
+    later := now.Add(3 * time.Minute)
+    if err := v.verify(newCreds("3", later), later); err != nil {
+        t.Fatal(err)
+    }
+    if v.count != 1 || len(v.buckets) != 1 {
+        t.Fatalf("expired nonces kept: %v in %v buckets", v.count, len(v.buckets))
+    }
+}
+
+func TestPrincipal(t *testing.T) {
+    p := &Principal{Name: "gm1", Roles: []string{"gm", "ops"}}
+    if !p.HasRole("gm") || p.HasRole("player") {
+        t.Fatalf("unexpected roles %v", p.Roles)
+    }
+}
@@ -0,0 +1,197 @@
+package client
+
+import (
+    "errors"
+    "sync"
+    "time"
+)
+
+var ErrBreakerOpen = errors.New("circuit breaker is open")
+var ErrMaxConcurrency = errors.New("max concurrent requests exceeded")
+
+const (
+    //滑动窗口分桶数
+    breakerBuckets = 10
+)
+
+//熔断器配置
+type BreakerConfig struct {
+    Timeout                time.Duration //单次调用超时
+    MaxConcurrentRequests  int           //最大并发请求数
+    Window                 time.Duration //错误率统计的滑动窗口
+    RequestVolumeThreshold int           //窗口内请求数达到该值才会计算错误率
+    ErrorPercentThreshold  int           //错误率达到该百分比则熔断
+    SleepWindow            time.Duration //熔断后多久进入半开状态
+    HalfOpenProbes         int           //半开状态下允许的探测请求数
+}
+
+var DefaultBreakerConfig = BreakerConfig{
+    Timeout:                2 * time.Second,
+    MaxConcurrentRequests:  50000,
+    Window:                 10 * time.Second,
+    RequestVolumeThreshold: 10,
+    ErrorPercentThreshold:  20,
+    SleepWindow:            5 * time.Second,
+    HalfOpenProbes:         1,
+}
+
+func (bc *BreakerConfig) check() error {
+    if bc.Timeout <= 0 {
+        return errors.New("breaker timeout should be positive")
+    }
+    if bc.MaxConcurrentRequests <= 0 {
+        return errors.New("breaker max concurrent requests should be positive")
+    }
+    if bc.Window < breakerBuckets*time.Millisecond {
+        return errors.New("breaker window too small")
+    }
+    if bc.ErrorPercentThreshold <= 0 || bc.ErrorPercentThreshold > 100 {
+        return errors.New("breaker error percent should be in (0, 100]")
+    }
+    if bc.SleepWindow <= 0 {
+        return errors.New("breaker sleep window should be positive")
+    }
+    if bc.HalfOpenProbes <= 0 {
+        return errors.New("breaker half-open probes should be positive")
+    }
+    return nil
+}
+
+type breakerState int
+
+const (
+    breakerClosed breakerState = iota
+    breakerOpen
+    breakerHalfOpen
+)
+
+func (bs breakerState) String() string {
+    switch bs {
+    case breakerClosed:
+        return "closed"
+    case breakerOpen:
+        return "open"
+    case breakerHalfOpen:
+        return "half-open"
+    }
+    return "unknown"
+}
+
+type breakerBucket struct {
+    epoch int64 //桶对应的时间片序号
+    succ  uint32
+    fail  uint32
+}
+
+//每个endpoint一个熔断器，滑动窗口统计错误率
+type circuitBreaker struct {
+    config *BreakerConfig
+    span   int64 //每个桶的时长(ns)
+
+    mu       sync.Mutex //protect following
+    state    breakerState
+    openedAt time.Time
+    probes   int //半开状态下正在进行的探测数
+    buckets  [breakerBuckets]breakerBucket
+}
+
+func newCircuitBreaker(config *BreakerConfig) *circuitBreaker {
+    return &circuitBreaker{
+        config: config,
+        span:   int64(config.Window) / breakerBuckets,
+    }
+}
+
+//是否可以放行请求，不占用半开探测名额，用于选取节点前的过滤
+func (cb *circuitBreaker) ready() bool {
+    cb.mu.Lock()
+    defer cb.mu.Unlock()
+    switch cb.state {
+    case breakerOpen:
+        return time.Since(cb.openedAt) >= cb.config.SleepWindow
+    case breakerHalfOpen:
+        return cb.probes < cb.config.HalfOpenProbes
+    }
+    return true
+}
+
+//申请放行请求，probe表示本次请求是半开状态下的探测
+func (cb *circuitBreaker) allow() (probe, ok bool) {
+    cb.mu.Lock()
+    defer cb.mu.Unlock()
+    switch cb.state {
+    case breakerClosed:
+        return false, true
+    case breakerOpen:
+        if time.Since(cb.openedAt) < cb.config.SleepWindow {
+            return false, false
+        }
+        cb.state = breakerHalfOpen
+        cb.probes = 0
+    }
+    if cb.probes >= cb.config.HalfOpenProbes {
+        return false, false
+    }
+    cb.probes++
+    return true, true
+}
+
+//上报请求结果
+func (cb *circuitBreaker) done(probe, succ bool) {
+    cb.mu.Lock()
+    defer cb.mu.Unlock()
+    now := time.Now()
+    if probe {
+        if cb.state != breakerHalfOpen {
+            return
+        }
+        cb.probes--
+        if succ {
+            cb.reset(breakerClosed, now)
+        } else {
+            cb.reset(breakerOpen, now)
+        }
+        return
+    }
+    if cb.state != breakerClosed {
+        return
+    }
+    epoch := now.UnixNano() / cb.span
+    b := &cb.buckets[epoch%breakerBuckets]
+    if b.epoch != epoch {
+        *b = breakerBucket{epoch: epoch}
+    }
+    if succ {
+        b.succ++
+        return
+    }
+    b.fail++
+
+    var total, fail uint32
+    for i := range cb.buckets {
+        if epoch-cb.buckets[i].epoch >= breakerBuckets {
+            continue
+        }
+        total += cb.buckets[i].succ + cb.buckets[i].fail
+        fail += cb.buckets[i].fail
+    }
+    if int(total) < cb.config.RequestVolumeThreshold {
+        return
+    }
+    if int(fail*100) >= int(total)*cb.config.ErrorPercentThreshold {
+        cb.reset(breakerOpen, now)
+    }
+}
+
+func (cb *circuitBreaker) reset(state breakerState, now time.Time) {
+    cb.state = state
+    cb.openedAt = now
+    cb.probes = 0
+    cb.buckets = [breakerBuckets]breakerBucket{}
+}
+
+func (cb *circuitBreaker) currentState() breakerState {
+    cb.mu.Lock()
+    defer cb.mu.Unlock()
+    return cb.state
+}
@@ -0,0 +1,125 @@
+package client
+
+import (
+    "testing"
+    "time"
+
+    "github.com/philipyao/prpc/codec"
+)
+
+func TestBreakerTrip(t *testing.T) {
+    config := DefaultBreakerConfig
+    config.SleepWindow = 50 * time.Millisecond
+    cb := newCircuitBreaker(&config)
+
+    //请求数未达到阈值，不熔断
+    for i := 0; i < config.RequestVolumeThreshold-1; i++ {
+        probe, ok := cb.allow()
+        if !ok || probe {
+            t.Fatalf("closed breaker should allow: probe %v ok %v", probe, ok)
+        }
+        cb.done(probe, false)
+    }
+    if cb.currentState() != breakerClosed {
+        t.Fatalf("breaker tripped below volume threshold")
+    }
+    cb.done(false, false)
+    if cb.currentState() != breakerOpen {
+        t.Fatalf("breaker should be open, got %v", cb.currentState())
+    }
+    if cb.ready() {
+        t.Fatal("open breaker should not be ready")
+    }
+    if _, ok := cb.allow(); ok {
+        t.Fatal("open breaker should reject")
+    }
+
+    //半开：只允许一个探测请求
+    time.Sleep(config.SleepWindow)
+    if !cb.ready() {
+        t.Fatal("breaker should be ready after sleep window")
+    }
+    probe, ok := cb.allow()
+    if !ok || !probe {
+        t.Fatalf("half-open breaker should allow a probe: probe %v ok %v", probe, ok)
+    }
+    if _, ok := cb.allow(); ok {
+        t.Fatal("half-open breaker should reject the second probe")
+    }
+    cb.done(probe, false)
+    if cb.currentState() != breakerOpen {
+        t.Fatalf("failed probe should reopen breaker, got %v", cb.currentState())
+    }
+
+    time.Sleep(config.SleepWindow)
+    probe, ok = cb.allow()
+    if !ok || !probe {
+        t.Fatalf("half-open breaker should allow a probe: probe %v ok %v", probe, ok)
+    }
+    cb.done(probe, true)
+    if cb.currentState() != breakerClosed {
+        t.Fatalf("succeeded probe should close breaker, got %v", cb.currentState())
+    }
+}
+
+func TestBreakerErrorPercent(t *testing.T) {
+    config := DefaultBreakerConfig
+    cb := newCircuitBreaker(&config)
+
+    //错误率 10% < 20%
+    for i := 0; i < 100; i++ {
+        cb.done(false, i%10 != 0)
+    }
+    if cb.currentState() != breakerClosed {
+        t.Fatalf("breaker tripped below error percent, got %v", cb.currentState())
+    }
+    for i := 0; i < 20; i++ {
+        cb.done(false, false)
+    }
+    if cb.currentState() != breakerOpen {
+        t.Fatalf("breaker should be open, got %v", cb.currentState())
+    }
+}
+
+func TestBreakerConfigCheck(t *testing.T) {
+    config := DefaultBreakerConfig
+    if err := config.check(); err != nil {
+        t.Fatalf("default config invalid: %v", err)
+    }
+    config.ErrorPercentThreshold = 0
+    if err := config.check(); err == nil {
+        t.Fatal("invalid config passed check")
+    }
+}
+
+type panicArgs struct{}
+
+func (panicArgs) MarshalJSON() ([]byte, error) {
+    panic("marshal args")
+}
+
+//半开探测的调用panic时归还探测名额
+func TestBreakerProbePanic(t *testing.T) {
+    config := DefaultBreakerConfig
+    config.SleepWindow = time.Millisecond
+    sc := newSvcClient("Arith", "zone1001", nil, WithVersionAll(), WithBreaker(config))
+    eps := makeEndpoints(10)
+    eps[0].breaker = newCircuitBreaker(&sc.breakerConfig)
+    eps[0].conn = makePipeConn()
+    eps[0].conn.styp = codec.SerializeTypeJson
+    sc.endPoints.Store(eps)
+
+    eps[0].breaker.reset(breakerOpen, time.Now().Add(-time.Second))
+    var reply int
+    for i := 0; i < 3; i++ {
+        sc.Call("Add", panicArgs{}, &reply)
+        //panic按失败处理，重新熔断
+        if state := eps[0].breaker.currentState(); state != breakerOpen {
+            t.Fatalf("breaker should reopen after panicked probe, got %v", state)
+        }
+        time.Sleep(2 * config.SleepWindow)
+        if !eps[0].breaker.ready() {
+            t.Fatal("probe slot leaked after panic")
+        }
+    }
+}
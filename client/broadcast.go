@@ -0,0 +1,145 @@
+package client
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "reflect"
+    "sort"
+    "sync"
+    "time"
+)
+
+//广播调用中单个节点的结果
+type BroadcastResult struct {
+    Index int
+    Addr  string
+    Reply interface{}
+    Error error
+}
+
+//为每个节点生成一个reply，必须返回非nil指针
+type FnReplyFactory func() interface{}
+
+type configBroadcast struct {
+    failFast bool
+    timeout  time.Duration
+}
+
+//broadcast 相关option
+type fnOptionBroadcast func(cb *configBroadcast) error
+
+func WithBroadcastFailFast() fnOptionBroadcast {
+    //任一节点失败即取消其余调用
+    return func(cb *configBroadcast) error {
+        cb.failFast = true
+        return nil
+    }
+}
+func WithBroadcastTimeout(timeout time.Duration) fnOptionBroadcast {
+    //整体超时，默认使用熔断配置中的调用超时
+    return func(cb *configBroadcast) error {
+        if timeout <= 0 {
+            return errors.New("broadcast timeout should be positive")
+        }
+        cb.timeout = timeout
+        return nil
+    }
+}
+
+//并发调用当前所有节点，按index顺序返回每个节点的结果；
+//与单次调用一样忽略禁用的节点，并按版本规则过滤，版本规则中的各个版本都会调用；
+//标签路由的各级是单次调用的回退顺序，广播调用匹配任意一级的节点，如 "idc=sz1; *" 调用全部节点；
+//不健康、已熔断的节点仍然调用，结果中返回各自的错误。
+//有节点失败时返回的error非nil，结果中仍然包含成功节点的reply
+func (sc *SvcClient) Broadcast(serviceMethod string, args interface{}, replyFactory FnReplyFactory,
+    opts ...fnOptionBroadcast) ([]*BroadcastResult, error) {
+    if replyFactory == nil {
+        return nil, errors.New("nil reply factory")
+    }
+    config := configBroadcast{timeout: sc.breakerConfig.Timeout}
+    for n, opt := range opts {
+        if opt == nil {
+            return nil, fmt.Errorf("err: decorate broadcast, nil option no.%v", n+1)
+        }
+        if err := opt(&config); err != nil {
+            return nil, err
+        }
+    }
+
+    candidates := sc.matchVersions(filterEndpoints(sc.loadEndpoints(), func(ep *endPoint) bool {
+        return !ep.disabled
+    }))
+    if sc.routeRule != nil && len(candidates) > 0 {
+        candidates = sc.routeRule.matchAny(candidates)
+        if len(candidates) == 0 {
+            return nil, errors.New("no rpc servers match route rule")
+        }
+    }
+    var eps []*endPoint
+    for _, ep := range candidates {
+        //节点已删除
+        if !ep.acquire() {
+            continue
+        }
+        eps = append(eps, ep)
+    }
+    if len(eps) == 0 {
+        return nil, errors.New("no available rpc servers")
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), config.timeout)
+    defer cancel()
+    smethod := fmt.Sprintf("%v.%v", sc.service, serviceMethod)
+    results := make([]*BroadcastResult, len(eps))
+    var (
+        wg       sync.WaitGroup
+        lock     sync.Mutex
+        firstErr error
+        failed   int
+    )
+    for i, ep := range eps {
+        result := &BroadcastResult{
+            Index: ep.index,
+            Addr:  ep.addr,
+            Reply: replyFactory(),
+        }
+        results[i] = result
+        wg.Add(1)
+        go func(ep *endPoint) {
+            defer wg.Done()
+            defer ep.release()
+
+            val := reflect.ValueOf(result.Reply)
+            if val.Kind() != reflect.Ptr || val.IsNil() {
+                result.Error = errors.New("reply should be pointer and not nil")
+            } else {
+                start := time.Now()
+                result.Error = ep.conn.Call(ctx, smethod, args, result.Reply)
+                ep.observe(start)
+            }
+            if result.Error == nil {
+                return
+            }
+            lock.Lock()
+            failed++
+            if firstErr == nil {
+                firstErr = fmt.Errorf("endpoint %v: %v", ep.index, result.Error)
+                if config.failFast {
+                    cancel()
+                }
+            }
+            lock.Unlock()
+        }(ep)
+    }
+    wg.Wait()
+
+    sort.Slice(results, func(i, j int) bool { return results[i].Index < results[j].Index })
+    if failed == 0 {
+        return results, nil
+    }
+    if config.failFast {
+        return results, firstErr
+    }
+    return results, fmt.Errorf("%v/%v endpoints failed, first error: %v", failed, len(results), firstErr)
+}
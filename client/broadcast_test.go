@@ -0,0 +1,171 @@
+package client
+
+import (
+    "bufio"
+    "fmt"
+    "net"
+    "testing"
+    "time"
+
+    "github.com/philipyao/prpc/codec"
+    "github.com/philipyao/prpc/message"
+)
+
+//简易的rpc服务端: Arith.Multiply，delay后返回
+func startFakeServer(t *testing.T, delay time.Duration) net.Listener {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    s := codec.GetSerializer(codec.SerializeTypeMsgpack)
+    go func() {
+        for {
+            conn, err := l.Accept()
+            if err != nil {
+                return
+            }
+            go func(conn net.Conn) {
+                defer conn.Close()
+                reader := bufio.NewReader(conn)
+                for {
+                    msg, err := message.NewResponse(reader)
+                    if err != nil {
+                        return
+                    }
+                    var args Args
+                    if err = msg.Unpack(s, &args); err != nil {
+                        return
+                    }
+                    time.Sleep(delay)
+                    data, err := message.NewRequest(message.MsgKindDefault, msg.Seqno()).
+                        Pack(msg.ServiceMethod(), args.A*args.B, s)
+                    if err != nil {
+                        return
+                    }
+                    conn.Write(data)
+                }
+            }(conn)
+        }
+    }()
+    return l
+}
+
+func TestBroadcast(t *testing.T) {
+    sc := newSvcClient("Arith", "zone1001", nil, WithVersionAll())
+    delays := []time.Duration{0, 0, 300 * time.Millisecond}
+    var eps []*endPoint
+    for i, delay := range delays {
+        l := startFakeServer(t, delay)
+        defer l.Close()
+        ep := makeEndpoints(10)[0]
+        ep.index = len(delays) - i
+        ep.addr = l.Addr().String()
+        ep.conn = newRPCClient(ep.addr, &configDial{styp: codec.SerializeTypeMsgpack, timeout: DialTimeout})
+        if ep.conn == nil {
+            t.Fatal("dial fake server failed")
+        }
+        defer ep.conn.Close()
+        eps = append(eps, ep)
+    }
+    sc.endPoints.Store(eps)
+
+    factory := func() interface{} { return new(int) }
+    results, err := sc.Broadcast("Multiply", &Args{A: 2, B: 3}, factory)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i, r := range results {
+        if r.Index != i+1 || r.Error != nil || *r.Reply.(*int) != 6 {
+            t.Fatalf("unexpected result %+v", r)
+        }
+    }
+
+    //整体超时，收集所有结果
+    start := time.Now()
+    results, err = sc.Broadcast("Multiply", &Args{A: 2, B: 3}, factory, WithBroadcastTimeout(100*time.Millisecond))
+    if err == nil {
+        t.Fatal("broadcast timeout with no error")
+    }
+    if time.Since(start) > 250*time.Millisecond {
+        t.Fatalf("broadcast not bounded by deadline: %v", time.Since(start))
+    }
+    if results[0].Error == nil || results[1].Error != nil || results[2].Error != nil {
+        t.Fatalf("unexpected results: %v %v %v", results[0].Error, results[1].Error, results[2].Error)
+    }
+
+    if _, err = sc.Broadcast("Multiply", &Args{}, func() interface{} { return 0 }); err == nil {
+        t.Fatal("non-pointer reply accepted")
+    }
+
+    //fail fast: 节点连接断开，取消其余调用
+    eps[1].conn.Close()
+    start = time.Now()
+    results, err = sc.Broadcast("Multiply", &Args{A: 2, B: 3}, factory, WithBroadcastFailFast())
+    if err == nil {
+        t.Fatal("fail fast broadcast with no error")
+    }
+    if time.Since(start) > 250*time.Millisecond {
+        t.Fatalf("fail fast broadcast waited for slow endpoint: %v", time.Since(start))
+    }
+    if results[0].Error == nil {
+        t.Fatal("slow endpoint not canceled")
+    }
+}
+
+//广播忽略禁用的节点，按版本规则和标签路由过滤
+func TestBroadcastFilter(t *testing.T) {
+    l := startFakeServer(t, 0)
+    defer l.Close()
+    eps := makeEndpoints(10, 10, 10, 10, 10)
+    versions := []string{"v1.0", "v1.0", "v1.1", "v1.2", "v2.0"}
+    for i, ep := range eps {
+        ep.version = versions[i]
+        ep.labels = map[string]string{"idc": "sz1"}
+        ep.addr = l.Addr().String()
+        ep.conn = newRPCClient(ep.addr, &configDial{styp: codec.SerializeTypeMsgpack, timeout: DialTimeout})
+        if ep.conn == nil {
+            t.Fatal("dial fake server failed")
+        }
+        defer ep.conn.Close()
+    }
+    eps[1].disabled = true
+    eps[2].labels = map[string]string{"idc": "sz2"}
+
+    factory := func() interface{} { return new(int) }
+    broadcast := func(opts ...fnOptionService) string {
+        sc := newSvcClient("Arith", "zone1001", nil, opts...)
+        sc.endPoints.Store(eps)
+        results, err := sc.Broadcast("Multiply", &Args{A: 2, B: 3}, factory)
+        if err != nil {
+            t.Fatal(err)
+        }
+        var indexes []int
+        for _, r := range results {
+            indexes = append(indexes, r.Index)
+        }
+        return fmt.Sprint(indexes)
+    }
+    for _, c := range []struct {
+        expect string
+        opts   []fnOptionService
+    }{
+        {"[1 3 4 5]", []fnOptionService{WithVersionAll()}},
+        {"[1]", nil},
+        {"[3 4]", []fnOptionService{WithVersionRule(">=v1.1 <v2.0")}},
+        //v1.3没有节点，这部分流量回退到缺省版本
+        {"[1 3]", []fnOptionService{WithVersionRule("v1.1:10%, v1.3:90%")}},
+        //路由的各级只是优先顺序，不只调用第一级
+        {"[1 3 4 5]", []fnOptionService{WithVersionAll(), WithRouteRule("idc=sz1; *")}},
+        {"[3]", []fnOptionService{WithVersionAll(), WithRouteRule("idc=sz2")}},
+    } {
+        if got := broadcast(c.opts...); got != c.expect {
+            t.Fatalf("broadcast to %v, expect %v", got, c.expect)
+        }
+    }
+
+    sc := newSvcClient("Arith", "zone1001", nil, WithVersion("v1.0"))
+    sc.endPoints.Store(eps[1:2])
+    if _, err := sc.Broadcast("Multiply", &Args{A: 2, B: 3}, factory); err == nil {
+        t.Fatal("broadcast to disabled endpoint")
+    }
+}
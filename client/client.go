@@ -40,6 +40,9 @@ func New(regConfig interface{}) *Client {
 
 func (c *Client) Service(service, group string, opts ...fnOptionService) *SvcClient {
     svc := newSvcClient(service, group, c.registry, opts...)
+    if svc == nil {
+        return nil
+    }
     id, err := svc.hashCode()
     if err != nil {
         log.Printf("[prpc][ERROR] system error: %v", err)
@@ -63,3 +66,16 @@ func (c *Client) Service(service, group string, opts ...fnOptionService) *SvcCli
     c.services[id] = svc
     return svc
 }
+
+//关闭所有service的连接，停止订阅
+func (c *Client) Close() {
+    c.registry.Close()
+
+    c.mu.Lock()
+    services := c.services
+    c.services = make(map[string]*SvcClient)
+    c.mu.Unlock()
+    for _, sc := range services {
+        sc.close()
+    }
+}
@@ -208,4 +208,39 @@ func TestGetService(t *testing.T) {
 //    }
 //    wg.Wait()
 //    svc.dumpMetrics()
-//}
\ No newline at end of file
+//}
+//选项不同的Service hash code不同，相同时复用
+func TestServiceHashCode(t *testing.T) {
+    hashCode := func(group string, opts ...fnOptionService) string {
+        id, err := newSvcClient("Arith", group, nil, opts...).hashCode()
+        if err != nil {
+            t.Fatal(err)
+        }
+        return id
+    }
+    if hashCode("zone1001") != hashCode("zone1001") {
+        t.Fatal("same options hash differently")
+    }
+    breaker := DefaultBreakerConfig
+    breaker.Timeout = time.Second
+    ids := map[string]bool{hashCode("zone1001"): true}
+    for _, opts := range [][]fnOptionService{
+        {WithHealthCheck(time.Second, time.Second)},
+        {WithHealthCheck(time.Second, 2*time.Second)},
+        {WithBreaker(breaker)},
+    } {
+        id := hashCode("zone1001", opts...)
+        if ids[id] {
+            t.Fatalf("options %v ignored", len(ids))
+        }
+        if hashCode("zone1001", opts...) != id {
+            t.Fatal("same options hash differently")
+        }
+        ids[id] = true
+    }
+
+    //字段拼接后相同
+    if hashCode("ab", WithVersion("c")) == hashCode("a", WithVersion("bc")) {
+        t.Fatal("different group and version share hash code")
+    }
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+    "hash/fnv"
+    "sort"
+    "strconv"
+)
+
+const (
+    //默认权重(10)的节点对应的虚拟节点数，虚拟节点数与权重成正比
+    ringReplicas      = 160
+    ringDefaultWeight = 10
+)
+
+//需要按照特定key路由到固定节点的请求参数实现此接口，如玩家id、房间id
+type HashKeyer interface {
+    HashKey() string
+}
+
+type ringMember struct {
+    key    string
+    weight int
+}
+
+//一致性hash环，构建后只读
+type hashRing struct {
+    members []ringMember      //构建环时的节点，用于判断节点是否变化
+    hashes  []uint32          //有序的虚拟节点hash
+    owners  map[uint32]string //虚拟节点 -> endpoint key
+}
+
+func newHashRing(endPoints []*endPoint) *hashRing {
+    ring := &hashRing{
+        owners: make(map[uint32]string),
+    }
+    for _, ep := range endPoints {
+        ring.members = append(ring.members, ringMember{key: ep.key, weight: ep.weight})
+        if ep.weight <= 0 {
+            continue
+        }
+        replicas := ringReplicas * ep.weight / ringDefaultWeight
+        if replicas <= 0 {
+            replicas = 1
+        }
+        //虚拟节点由endpoint的key决定，增删节点时其他节点的位置不变
+        for i := 0; i < replicas; i++ {
+            h := hashString(ep.key + "#" + strconv.Itoa(i))
+            if _, exist := ring.owners[h]; exist {
+                continue
+            }
+            ring.owners[h] = ep.key
+            ring.hashes = append(ring.hashes, h)
+        }
+    }
+    sort.Slice(ring.hashes, func(i, j int) bool { return ring.hashes[i] < ring.hashes[j] })
+    return ring
+}
+
+//节点列表及其权重是否与构建环时一致
+func (ring *hashRing) match(endPoints []*endPoint) bool {
+    if len(ring.members) != len(endPoints) {
+        return false
+    }
+    for i, ep := range endPoints {
+        if ring.members[i].key != ep.key || ring.members[i].weight != ep.weight {
+            return false
+        }
+    }
+    return true
+}
+
+//顺时针找到第一个属于候选节点的虚拟节点，不可用的节点直接跳过，
+//其上的key落到下一个节点，节点恢复后回到原节点
+func (ring *hashRing) get(key string, candidates map[string]*endPoint) *endPoint {
+    n := len(ring.hashes)
+    if n == 0 || len(candidates) == 0 {
+        return nil
+    }
+    h := hashString(key)
+    i := sort.Search(n, func(i int) bool { return ring.hashes[i] >= h })
+    for j := 0; j < n; j++ {
+        if ep, ok := candidates[ring.owners[ring.hashes[(i+j)%n]]]; ok {
+            return ep
+        }
+    }
+    return nil
+}
+
+//fnv-1a后再用murmur3的fmix64打散，相似的key(如虚拟节点名)也能均匀分布
+func hashString(s string) uint32 {
+    h := fnv.New64a()
+    h.Write([]byte(s))
+    k := h.Sum64()
+    k ^= k >> 33
+    k *= 0xff51afd7ed558ccd
+    k ^= k >> 33
+    k *= 0xc4ceb9fe1a85ec53
+    k ^= k >> 33
+    return uint32(k)
+}
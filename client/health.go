@@ -0,0 +1,78 @@
+package client
+
+import (
+    "context"
+    "errors"
+    "log"
+    "sync"
+    "time"
+
+    "github.com/philipyao/prpc/codec"
+)
+
+const (
+    //server内置的健康检查服务
+    healthServiceMethod = "Health.Check"
+    healthServing       = "SERVING"
+)
+
+//主动健康检查：定期调用每个节点的Health.Check，不健康的节点不参与选取
+func (sc *SvcClient) healthCheck() {
+    defer sc.wg.Done()
+
+    ticker := time.NewTicker(sc.healthInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-sc.exit:
+            return
+        case <-ticker.C:
+        }
+        var wg sync.WaitGroup
+        for _, ep := range sc.loadEndpoints() {
+            wg.Add(1)
+            go func(ep *endPoint) {
+                defer wg.Done()
+                sc.probeHealth(ep)
+            }(ep)
+        }
+        wg.Wait()
+    }
+}
+
+func (sc *SvcClient) probeHealth(ep *endPoint) {
+    if !ep.acquire() {
+        //节点已删除
+        return
+    }
+    defer ep.release()
+
+    ctx, cancel := context.WithTimeout(context.Background(), sc.healthTimeout)
+    defer cancel()
+    var status string
+    //固定使用messagepack，与节点的序列化方式无关
+    err := ep.conn.callWith(ctx, codec.SerializeTypeMsgpack, healthServiceMethod, sc.service, &status)
+    if err == nil && status != healthServing {
+        err = errors.New(status)
+    }
+    healthy := err == nil
+
+    ep.stats.lock.Lock()
+    changed := ep.stats.unhealthy == healthy
+    ep.stats.unhealthy = !healthy
+    ep.stats.lock.Unlock()
+    if !changed {
+        return
+    }
+    if healthy {
+        log.Printf("[prpc] endpoint<%v> health check ok, back to service", ep.key)
+    } else {
+        log.Printf("[prpc][ERROR] endpoint<%v> health check failed: %v", ep.key, err)
+    }
+}
+
+func (ep *endPoint) healthy() bool {
+    ep.stats.lock.Lock()
+    defer ep.stats.lock.Unlock()
+    return !ep.stats.unhealthy
+}
@@ -1,5 +1,13 @@
 package client
 
+import (
+    "crypto/tls"
+    "time"
+
+    "github.com/philipyao/prpc/auth"
+    "github.com/philipyao/prpc/compress"
+)
+
 type configSelect struct {
     typ   selectType
     index int //specify which endpoint to select
@@ -19,6 +27,20 @@ func WithVersionAll() fnOptionService {
     //要兼容所有版本
     return WithVersion(noSpecifiedVersion)
 }
+func WithVersionRule(rule string) fnOptionService {
+    //按版本分流，如 "v1.1:10%, v1.0:90%"、">=v1.1"，
+    //所选版本没有可用节点(禁用、不健康、熔断等)时回退到缺省版本
+    return func(sc *SvcClient) error {
+        return sc.setVersionRule(rule)
+    }
+}
+func WithRouteRule(rule string) fnOptionService {
+    //按节点标签路由，多级之间用';'分隔，按顺序逐级尝试，
+    //如 "idc=sz1; region=south; *" 同机房优先，其次同地区，最后任意节点
+    return func(sc *SvcClient) error {
+        return sc.setRouteRule(rule)
+    }
+}
 func WithIndex(index int) fnOptionService {
     return func(sc *SvcClient) error {
         return sc.setIndex(index)
@@ -29,3 +51,57 @@ func WithSelectType(styp selectType) fnOptionService {
         return sc.setSelectType(styp)
     }
 }
+func WithBreaker(config BreakerConfig) fnOptionService {
+    //自定义熔断配置
+    return func(sc *SvcClient) error {
+        return sc.setBreakerConfig(config)
+    }
+}
+func WithTLSConfig(config *tls.Config) fnOptionService {
+    //连接注册为TLS的节点时使用，如需双向认证设置Certificates；
+    //未指定时使用系统根证书校验服务端，非TLS节点不受影响
+    return func(sc *SvcClient) error {
+        return sc.setTLSConfig(config)
+    }
+}
+func WithCompress(kind compress.Kind, threshold int) fnOptionService {
+    //请求超过threshold字节时压缩，节点不支持kind时使用gzip；
+    //threshold为0使用默认阈值，compress.None不压缩
+    return func(sc *SvcClient) error {
+        return sc.setCompress(kind, threshold)
+    }
+}
+func WithCredentials(creds auth.CredentialsProvider) fnOptionService {
+    //每个连接建立后发送凭证，如 auth.HMAC(id, secret)
+    return func(sc *SvcClient) error {
+        return sc.setCredentials(creds)
+    }
+}
+func WithSelector(s Selector) fnOptionService {
+    //使用自定义选择器
+    return func(sc *SvcClient) error {
+        return sc.setSelector(s, "")
+    }
+}
+func WithSelectorName(name string) fnOptionService {
+    //使用通过 RegisterSelector 注册的选择器
+    return func(sc *SvcClient) error {
+        factory, err := lookupSelector(name)
+        if err != nil {
+            return err
+        }
+        return sc.setSelector(factory(), name)
+    }
+}
+func WithOutlierDetection(config OutlierConfig, hook FnOutlierHook) fnOptionService {
+    //开启被动健康检查，hook可以为nil
+    return func(sc *SvcClient) error {
+        return sc.setOutlierDetection(config, hook)
+    }
+}
+func WithHealthCheck(interval, timeout time.Duration) fnOptionService {
+    //开启主动健康检查，定期调用节点的内置Health服务
+    return func(sc *SvcClient) error {
+        return sc.setHealthCheck(interval, timeout)
+    }
+}
@@ -0,0 +1,247 @@
+package client
+
+import (
+    "errors"
+    "log"
+    "sync"
+    "time"
+)
+
+var ErrEndpointEjected = errors.New("endpoint ejected by outlier detection")
+
+//被动健康检查配置：根据调用结果摘除异常节点
+type OutlierConfig struct {
+    ConsecutiveFailures int           //连续失败次数达到该值则摘除
+    ErrorPercent        int           //统计周期内错误率达到该百分比则摘除
+    MinRequests         int           //统计周期内请求数达到该值才计算错误率
+    Interval            time.Duration //错误率统计周期
+    BaseEjectionTime    time.Duration //摘除时长，随连续摘除次数递增
+    MaxEjectionTime     time.Duration //最长摘除时长
+    MaxEjectionPercent  int           //最多摘除的节点比例
+}
+
+var DefaultOutlierConfig = OutlierConfig{
+    ConsecutiveFailures: 5,
+    ErrorPercent:        50,
+    MinRequests:         20,
+    Interval:            10 * time.Second,
+    BaseEjectionTime:    30 * time.Second,
+    MaxEjectionTime:     300 * time.Second,
+    MaxEjectionPercent:  50,
+}
+
+func (oc *OutlierConfig) check() error {
+    if oc.ConsecutiveFailures <= 0 {
+        return errors.New("outlier consecutive failures should be positive")
+    }
+    if oc.ErrorPercent <= 0 || oc.ErrorPercent > 100 {
+        return errors.New("outlier error percent should be in (0, 100]")
+    }
+    if oc.Interval <= 0 || oc.BaseEjectionTime <= 0 {
+        return errors.New("outlier interval and ejection time should be positive")
+    }
+    if oc.MaxEjectionTime < oc.BaseEjectionTime {
+        return errors.New("outlier max ejection time less than base ejection time")
+    }
+    if oc.MaxEjectionPercent < 0 || oc.MaxEjectionPercent > 100 {
+        return errors.New("outlier max ejection percent should be in [0, 100]")
+    }
+    return nil
+}
+
+//节点摘除或恢复的事件
+type OutlierEvent struct {
+    Service  string
+    Group    string
+    Index    int
+    Addr     string
+    Ejected  bool          //true: 被摘除, false: 探测成功后恢复
+    Duration time.Duration //摘除时长
+    Reason   string
+}
+
+type FnOutlierHook func(ev *OutlierEvent)
+
+//单个节点的异常检测状态，节点数据更新生成新的endPoint时沿用
+type outlierDetector struct {
+    config *OutlierConfig
+
+    lock        sync.Mutex //protect following
+    consecutive int
+    succ        int
+    fail        int
+    windowStart time.Time
+    ejected     bool
+    until       time.Time
+    admittedAt  time.Time
+    ejections   int  //连续摘除次数，决定摘除时长
+    probing     bool //摘除到期后，正在进行恢复探测
+}
+
+func newOutlierDetector(config *OutlierConfig) *outlierDetector {
+    if config == nil {
+        return nil
+    }
+    return &outlierDetector{
+        config:      config,
+        windowStart: time.Now(),
+    }
+}
+
+//是否可以参与选取，不占用探测名额
+func (od *outlierDetector) ready() bool {
+    if od == nil {
+        return true
+    }
+    od.lock.Lock()
+    defer od.lock.Unlock()
+    if !od.ejected {
+        return true
+    }
+    return !od.probing && !time.Now().Before(od.until)
+}
+
+//申请调用，probe表示本次调用是摘除到期后的恢复探测
+func (od *outlierDetector) allow() (probe, ok bool) {
+    if od == nil {
+        return false, true
+    }
+    od.lock.Lock()
+    defer od.lock.Unlock()
+    if !od.ejected {
+        return false, true
+    }
+    if od.probing || time.Now().Before(od.until) {
+        return false, false
+    }
+    od.probing = true
+    return true, true
+}
+
+//上报调用结果
+//返回 eject: 需要摘除该节点; admit: 探测成功，节点恢复
+func (od *outlierDetector) report(probe, succ bool) (eject bool, reason string, admit bool) {
+    if od == nil {
+        return false, "", false
+    }
+    od.lock.Lock()
+    defer od.lock.Unlock()
+    now := time.Now()
+    if probe {
+        od.probing = false
+        if succ {
+            od.ejected = false
+            od.admittedAt = now
+            od.resetWindow(now)
+            return false, "", true
+        }
+        return true, "probe failed", false
+    }
+    if od.ejected {
+        return false, "", false
+    }
+    if now.Sub(od.windowStart) >= od.config.Interval {
+        od.resetWindow(now)
+    }
+    if succ {
+        od.succ++
+        od.consecutive = 0
+        return false, "", false
+    }
+    od.fail++
+    od.consecutive++
+    if od.consecutive >= od.config.ConsecutiveFailures {
+        return true, "consecutive failures", false
+    }
+    total := od.succ + od.fail
+    if total >= od.config.MinRequests && od.fail*100 >= total*od.config.ErrorPercent {
+        return true, "error percent", false
+    }
+    return false, "", false
+}
+
+//摘除节点，返回摘除时长
+func (od *outlierDetector) eject() time.Duration {
+    od.lock.Lock()
+    defer od.lock.Unlock()
+    now := time.Now()
+    //恢复后稳定运行足够久，重新计算摘除时长
+    if !od.ejected && !od.admittedAt.IsZero() && now.Sub(od.admittedAt) >= od.config.MaxEjectionTime {
+        od.ejections = 0
+    }
+    od.ejections++
+    d := od.config.BaseEjectionTime * time.Duration(od.ejections)
+    if d > od.config.MaxEjectionTime {
+        d = od.config.MaxEjectionTime
+    }
+    od.ejected = true
+    od.until = now.Add(d)
+    od.probing = false
+    od.resetWindow(now)
+    return d
+}
+
+//放弃已申请的探测
+func (od *outlierDetector) cancelProbe() {
+    od.lock.Lock()
+    od.probing = false
+    od.lock.Unlock()
+}
+
+func (od *outlierDetector) isEjected() bool {
+    if od == nil {
+        return false
+    }
+    od.lock.Lock()
+    defer od.lock.Unlock()
+    return od.ejected
+}
+
+func (od *outlierDetector) resetWindow(now time.Time) {
+    od.windowStart = now
+    od.succ = 0
+    od.fail = 0
+    od.consecutive = 0
+}
+
+//根据调用结果摘除或恢复节点，摘除的节点数受MaxEjectionPercent限制
+func (sc *SvcClient) reportOutlier(ep *endPoint, probe, succ bool) {
+    eject, reason, admit := ep.outlier.report(probe, succ)
+    var ev *OutlierEvent
+    switch {
+    case admit:
+        ev = &OutlierEvent{Reason: "probe succeeded"}
+    case eject:
+        sc.outlierLock.Lock()
+        eps := sc.loadEndpoints()
+        ejected := 0
+        for _, e := range eps {
+            if e.key != ep.key && e.outlier.isEjected() {
+                ejected++
+            }
+        }
+        if (ejected+1)*100 <= len(eps)*sc.outlierConfig.MaxEjectionPercent {
+            ev = &OutlierEvent{
+                Ejected:  true,
+                Duration: ep.outlier.eject(),
+                Reason:   reason,
+            }
+        }
+        sc.outlierLock.Unlock()
+    }
+    if ev == nil {
+        return
+    }
+    ev.Service = sc.service
+    ev.Group = sc.group
+    ev.Index = ep.index
+    ev.Addr = ep.addr
+    if ev.Ejected {
+        log.Printf("[prpc][ERROR] endpoint<%v> ejected for %v: %v", ep.key, ev.Duration, ev.Reason)
+    } else {
+        log.Printf("[prpc] endpoint<%v> re-admitted", ep.key)
+    }
+    if sc.outlierHook != nil {
+        sc.outlierHook(ev)
+    }
+}
@@ -0,0 +1,134 @@
+package client
+
+import (
+    "testing"
+    "time"
+)
+
+func TestOutlierDetection(t *testing.T) {
+    config := DefaultOutlierConfig
+    config.BaseEjectionTime = 50 * time.Millisecond
+    config.MaxEjectionTime = 80 * time.Millisecond
+
+    var events []*OutlierEvent
+    hook := func(ev *OutlierEvent) {
+        events = append(events, ev)
+    }
+    sc := newSvcClient("Arith", "zone1001", nil, WithVersionAll(), WithOutlierDetection(config, hook))
+    if sc == nil {
+        t.Fatal("new service client failed")
+    }
+    eps := makeEndpoints(10, 10, 10, 10)
+    for _, ep := range eps {
+        ep.breaker = newCircuitBreaker(&sc.breakerConfig)
+        ep.outlier = newOutlierDetector(sc.outlierConfig)
+    }
+    sc.endPoints.Store(eps)
+
+    //连续失败，摘除
+    bad := eps[0]
+    for i := 0; i < config.ConsecutiveFailures; i++ {
+        probe, ok := bad.outlier.allow()
+        if !ok || probe {
+            t.Fatalf("healthy endpoint rejected: probe %v ok %v", probe, ok)
+        }
+        sc.reportOutlier(bad, probe, false)
+    }
+    if len(events) != 1 || !events[0].Ejected || events[0].Index != bad.index {
+        t.Fatalf("unexpected events %+v", events)
+    }
+    for i := 0; i < 20; i++ {
+        ep, err := sc.selectEndpoint(sc.loadEndpoints(), &callInfo{})
+        if err != nil {
+            t.Fatal(err)
+        }
+        if ep == bad {
+            t.Fatal("ejected endpoint selected")
+        }
+    }
+
+    //最多摘除50%
+    for _, ep := range eps[1:] {
+        for i := 0; i < config.ConsecutiveFailures; i++ {
+            sc.reportOutlier(ep, false, false)
+        }
+    }
+    ejected := 0
+    for _, ep := range eps {
+        if ep.outlier.isEjected() {
+            ejected++
+        }
+    }
+    if ejected != 2 {
+        t.Fatalf("%v endpoints ejected, expect 2", ejected)
+    }
+
+    //摘除到期后探测失败，摘除时长递增
+    events = nil
+    time.Sleep(config.BaseEjectionTime)
+    probe, ok := bad.outlier.allow()
+    if !ok || !probe {
+        t.Fatalf("expired endpoint should be probed: probe %v ok %v", probe, ok)
+    }
+    if bad.outlier.ready() {
+        t.Fatal("endpoint ready while probing")
+    }
+    sc.reportOutlier(bad, probe, false)
+    if len(events) != 1 || events[0].Duration != config.MaxEjectionTime {
+        t.Fatalf("unexpected events %+v", events)
+    }
+
+    //探测成功，恢复
+    events = nil
+    time.Sleep(config.MaxEjectionTime)
+    probe, ok = bad.outlier.allow()
+    if !ok || !probe {
+        t.Fatalf("expired endpoint should be probed: probe %v ok %v", probe, ok)
+    }
+    sc.reportOutlier(bad, probe, true)
+    if len(events) != 1 || events[0].Ejected {
+        t.Fatalf("unexpected events %+v", events)
+    }
+    if bad.outlier.isEjected() || !bad.outlier.ready() {
+        t.Fatal("endpoint not re-admitted")
+    }
+}
+
+func TestOutlierErrorPercent(t *testing.T) {
+    config := DefaultOutlierConfig
+    od := newOutlierDetector(&config)
+    for i := 0; i < config.MinRequests-1; i++ {
+        if eject, _, _ := od.report(false, i%2 == 0); eject {
+            t.Fatal("ejected below min requests")
+        }
+    }
+    if eject, reason, _ := od.report(false, false); !eject {
+        t.Fatal("not ejected at error percent")
+    } else {
+        t.Logf("ejected: %v", reason)
+    }
+}
+
+//是否开启被动健康检查及其配置参与hashCode
+func TestOutlierHashCode(t *testing.T) {
+    config := DefaultOutlierConfig
+    ids := make(map[string]bool)
+    for _, opts := range [][]fnOptionService{
+        nil,
+        {WithOutlierDetection(config, nil)},
+        {WithOutlierDetection(config, func(ev *OutlierEvent) {})},
+        {WithOutlierDetection(OutlierConfig{
+            ConsecutiveFailures: 3, ErrorPercent: 50, Interval: time.Second,
+            BaseEjectionTime: time.Second, MaxEjectionTime: time.Second,
+        }, nil)},
+    } {
+        id, err := newSvcClient("Arith", "zone1001", nil, opts...).hashCode()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if ids[id] {
+            t.Fatalf("outlier options %v share hash code", len(ids))
+        }
+        ids[id] = true
+    }
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+    "fmt"
+    "strings"
+)
+
+//标签条件: key=value、key!=value、key(存在该标签)
+type labelCondition struct {
+    key   string
+    value string
+    op    string
+}
+
+func (lc *labelCondition) match(labels map[string]string) bool {
+    v, exist := labels[lc.key]
+    switch lc.op {
+    case "=":
+        return exist && v == lc.value
+    case "!=":
+        return !exist || v != lc.value
+    }
+    return exist
+}
+
+//同一级的条件需要同时满足，"*"匹配任意节点
+type routeLevel struct {
+    conditions []*labelCondition
+}
+
+func (rl *routeLevel) match(labels map[string]string) bool {
+    for _, c := range rl.conditions {
+        if !c.match(labels) {
+            return false
+        }
+    }
+    return true
+}
+
+//按标签路由的规则，多级之间用';'分隔，按顺序逐级尝试，
+//如 "idc=sz1; region=south; *" 表示同机房优先，其次同地区，最后任意节点
+type routeRule struct {
+    text   string
+    levels []*routeLevel
+}
+
+func parseRouteRule(text string) (*routeRule, error) {
+    rule := &routeRule{text: text}
+    for _, item := range strings.Split(text, ";") {
+        item = strings.TrimSpace(item)
+        if item == "" {
+            return nil, fmt.Errorf("empty level in route rule %q", text)
+        }
+        level := new(routeLevel)
+        if item != "*" {
+            for _, cond := range strings.Split(item, ",") {
+                c, err := parseLabelCondition(strings.TrimSpace(cond))
+                if err != nil {
+                    return nil, fmt.Errorf("%v in route rule %q", err, text)
+                }
+                level.conditions = append(level.conditions, c)
+            }
+        }
+        rule.levels = append(rule.levels, level)
+    }
+    return rule, nil
+}
+
+func parseLabelCondition(s string) (*labelCondition, error) {
+    c := new(labelCondition)
+    switch {
+    case strings.Contains(s, "!="):
+        i := strings.Index(s, "!=")
+        c.key, c.value, c.op = s[:i], s[i+2:], "!="
+    case strings.Contains(s, "="):
+        i := strings.Index(s, "=")
+        c.key, c.value, c.op = s[:i], s[i+1:], "="
+    default:
+        c.key = s
+    }
+    c.key = strings.TrimSpace(c.key)
+    c.value = strings.TrimSpace(c.value)
+    if c.key == "" {
+        return nil, fmt.Errorf("invalid label condition %q", s)
+    }
+    return c, nil
+}
+
+//返回第一级有匹配的节点，都不匹配时返回空
+func (rule *routeRule) pick(endPoints []*endPoint) []*endPoint {
+    for _, level := range rule.levels {
+        eps := filterEndpoints(endPoints, func(ep *endPoint) bool {
+            return level.match(ep.labels)
+        })
+        if len(eps) > 0 {
+            return eps
+        }
+    }
+    return nil
+}
+
+//返回任意一级匹配的节点，广播时各级只是优先顺序，不作为过滤
+func (rule *routeRule) matchAny(endPoints []*endPoint) []*endPoint {
+    return filterEndpoints(endPoints, func(ep *endPoint) bool {
+        for _, level := range rule.levels {
+            if level.match(ep.labels) {
+                return true
+            }
+        }
+        return false
+    })
+}
+
+func equalLabels(a, b map[string]string) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for k, v := range a {
+        if bv, exist := b[k]; !exist || bv != v {
+            return false
+        }
+    }
+    return true
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+    "testing"
+
+    "github.com/philipyao/prpc/registry"
+)
+
+func TestParseRouteRule(t *testing.T) {
+    for _, text := range []string{"idc=sz1; region=south; *", "idc=sz1,hw!=arm", "shard", "*"} {
+        if _, err := parseRouteRule(text); err != nil {
+            t.Fatalf("parse %q: %v", text, err)
+        }
+    }
+    for _, text := range []string{"", "idc=sz1;", "=sz1", "idc=sz1,,region=south"} {
+        if _, err := parseRouteRule(text); err == nil {
+            t.Fatalf("invalid rule %q parsed", text)
+        }
+    }
+}
+
+func TestRouteRule(t *testing.T) {
+    sc := newSvcClient("Arith", "zone1001", nil, WithVersionAll(), WithRouteRule("idc=sz1; region=south"))
+    if sc == nil {
+        t.Fatal("new service client failed")
+    }
+    eps := makeEndpoints(10, 10, 10)
+    eps[0].labels = map[string]string{"region": "south", "idc": "sz1"}
+    eps[1].labels = map[string]string{"region": "south", "idc": "gz1"}
+    eps[2].labels = map[string]string{"region": "north", "idc": "bj1"}
+    for _, ep := range eps {
+        ep.breaker = newCircuitBreaker(&sc.breakerConfig)
+    }
+    sc.endPoints.Store(eps)
+
+    expectSelected := func(expect *endPoint) {
+        for i := 0; i < 20; i++ {
+            ep, err := sc.selectEndpoint(sc.loadEndpoints(), &callInfo{})
+            if err != nil {
+                t.Fatal(err)
+            }
+            if ep.key != expect.key {
+                t.Fatalf("endpoint %v selected, expect %v", ep.index, expect.index)
+            }
+        }
+    }
+    //同机房优先
+    expectSelected(eps[0])
+
+    //同机房节点不可用，选同地区
+    eps[0].stats.unhealthy = true
+    expectSelected(eps[1])
+
+    //标签在线变化后重新计算
+    sc.updateEndpoint(&registry.Node{
+        Path: eps[2].key,
+        NodeOption: &registry.NodeOption{
+            Weight:  10,
+            Version: "v1.0",
+            Labels:  map[string]string{"region": "south", "idc": "sz1"},
+        },
+    })
+    expectSelected(eps[2])
+
+    //没有匹配的节点
+    north := makeEndpoints(10)[0]
+    north.labels = map[string]string{"region": "north"}
+    north.breaker = newCircuitBreaker(&sc.breakerConfig)
+    sc.endPoints.Store([]*endPoint{north})
+    if _, err := sc.selectEndpoint(sc.loadEndpoints(), &callInfo{}); err == nil {
+        t.Fatal("endpoint selected without any match")
+    }
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+    "crypto/tls"
     "errors"
     "fmt"
     "io"
@@ -9,8 +10,11 @@ import (
     "strings"
     "sync"
 
+    "github.com/philipyao/prpc/auth"
     "github.com/philipyao/prpc/codec"
+    "github.com/philipyao/prpc/compress"
     "github.com/philipyao/prpc/message"
+    "github.com/philipyao/prpc/transport"
     "bufio"
     "context"
     "time"
@@ -20,11 +24,50 @@ var ErrShutdown = errors.New("shut down")
 var ErrBeClosed = errors.New("connection closed by peer")
 var ErrNetClosing = errors.New("use of closed network connection")
 
+//服务端handler返回的错误
+type ServerError string
+
+func (e ServerError) Error() string {
+    return string(e)
+}
+
+//调用方没有权限调用该方法
+type PermissionDeniedError struct {
+    ServiceMethod string
+    Message       string
+}
+
+func (e *PermissionDeniedError) Error() string {
+    return e.Message
+}
+
+func IsPermissionDenied(err error) bool {
+    _, ok := err.(*PermissionDeniedError)
+    return ok
+}
+
+//服务端返回的业务错误，节点本身正常
+func isServerError(err error) bool {
+    switch err.(type) {
+    case ServerError, *PermissionDeniedError:
+        return true
+    }
+    return false
+}
+
+func rpcError(serviceMethod string, code message.ErrCode, errmsg string) error {
+    if code == message.ErrCodePermissionDenied {
+        return &PermissionDeniedError{ServiceMethod: serviceMethod, Message: errmsg}
+    }
+    return ServerError(errmsg)
+}
+
 const (
     BuffSizeReader      = 64 * 1024     //64K
     //BuffSizeWriter      = 64 * 1024     //64k
 
     ReadTimeout         = 5 * time.Second
+    DialTimeout         = 3 * time.Second
 )
 
 type FnCallback func(a interface{}, r interface{}, e error)
@@ -38,6 +81,8 @@ type Call struct {
     Done          chan *Call  // Strobes when call is complete.
     fn            FnCallback
     Seq           uint16
+    styp          codec.SerializeType //payload的序列化方式，写入head
+    serializer    codec.Serializer
 }
 
 func (call *Call) done() {
@@ -54,7 +99,11 @@ func (call *Call) done() {
 type RPCClient struct {
     conn       net.Conn
     reader     *bufio.Reader    //带缓冲读取
+    styp       codec.SerializeType
     serializer codec.Serializer
+    compress   compress.Kind //请求的压缩方式，同时要求服务端以此方式返回
+    threshold  int           //压缩阈值
+    legacy     bool          //对端只支持旧版本的包格式
 
     mutex    sync.Mutex // protects following
     seq      uint16
@@ -67,25 +116,142 @@ type RPCClient struct {
     //todo inservice 检测本rpc依赖的dependency是否ok
 }
 
-func newRPCClient(addr string, styp codec.SerializeType) *RPCClient {
-    serializer := codec.GetSerializer(styp)
-    if serializer == nil {
-        log.Printf("[prpc][ERROR] styp %v not support", styp)
+type configDial struct {
+    styp      codec.SerializeType
+    timeout   time.Duration
+    tlsConfig *tls.Config
+    creds     auth.CredentialsProvider
+    compress  compress.Kind
+    threshold int
+    legacy    bool
+}
+
+//dial 相关option
+type FnOptionDial func(cd *configDial) error
+
+func WithDialSerialize(styp codec.SerializeType) FnOptionDial {
+    //连接上调用的默认序列化方式，默认messagepack；序列化方式写在每个包的包头中，
+    //服务端按包头解码并以相同方式返回，同一连接上的调用可以使用不同的方式(如健康检查固定使用messagepack)；
+    //对端为旧版本服务端(WithDialLegacy)时需要与服务端的序列化方式一致
+    return func(cd *configDial) error {
+        cd.styp = styp
         return nil
     }
-    addr = strings.TrimSpace(addr)
-    conn, err := net.Dial("tcp", addr)
+}
+func WithDialTimeout(timeout time.Duration) FnOptionDial {
+    return func(cd *configDial) error {
+        if timeout <= 0 {
+            return errors.New("dial timeout should be positive")
+        }
+        cd.timeout = timeout
+        return nil
+    }
+}
+
+func WithDialTLS(config *tls.Config) FnOptionDial {
+    //使用TLS连接，ServerName为空时取地址中的host
+    return func(cd *configDial) error {
+        if config == nil {
+            return errors.New("nil tls config")
+        }
+        cd.tlsConfig = config
+        return nil
+    }
+}
+
+func WithDialCompress(kind compress.Kind, threshold int) FnOptionDial {
+    //请求超过threshold字节时使用kind压缩，服务端以相同方式压缩返回；
+    //默认gzip，threshold为0使用默认阈值，compress.None不压缩
+    return func(cd *configDial) error {
+        if kind != compress.None && compress.Get(kind) == nil {
+            return &compress.UnsupportedError{Kind: kind}
+        }
+        cd.compress = kind
+        cd.threshold = threshold
+        return nil
+    }
+}
+
+func WithDialLegacy() FnOptionDial {
+    //对端是尚未升级的旧版本服务端，按旧版本打包，使用WithDialSerialize指定的服务端序列化方式
+    return func(cd *configDial) error {
+        cd.legacy = true
+        return nil
+    }
+}
+
+func WithDialCredentials(creds auth.CredentialsProvider) FnOptionDial {
+    //连接建立后发送凭证，服务端认证通过才能调用
+    return func(cd *configDial) error {
+        if creds == nil {
+            return errors.New("nil credentials provider")
+        }
+        cd.creds = creds
+        return nil
+    }
+}
+
+//不经过注册中心，直接连接已知地址的rpc server，用于工具、测试以及server之间的点对点连接
+func Dial(addr string, opts ...FnOptionDial) (*RPCClient, error) {
+    config := configDial{
+        styp:     codec.SerializeTypeMsgpack,
+        timeout:  DialTimeout,
+        compress: compress.Gzip,
+    }
+    for n, opt := range opts {
+        if opt == nil {
+            return nil, fmt.Errorf("err: decorate dial, nil option no.%v", n+1)
+        }
+        if err := opt(&config); err != nil {
+            return nil, err
+        }
+    }
+    return dial(addr, &config)
+}
+
+func newRPCClient(addr string, config *configDial) *RPCClient {
+    client, err := dial(addr, config)
     if err != nil {
-        log.Printf("[prpc][ERROR] conn to rpc server<%v> error %v", addr, err)
+        log.Printf("[prpc][ERROR] %v", err)
         return nil
     }
+    return client
+}
+
+func dial(addr string, config *configDial) (*RPCClient, error) {
+    serializer := codec.GetSerializer(config.styp)
+    if serializer == nil {
+        return nil, fmt.Errorf("styp %v not support", config.styp)
+    }
+    addr = strings.TrimSpace(addr)
+    conn, err := transport.Dial(addr, config.timeout)
+    if err != nil {
+        return nil, fmt.Errorf("conn to rpc server<%v> error %v", addr, err)
+    }
+    if config.tlsConfig != nil {
+        conn, err = tlsHandshake(conn, addr, config.timeout, config.tlsConfig)
+        if err != nil {
+            return nil, fmt.Errorf("tls handshake with rpc server<%v> error %v", addr, err)
+        }
+    }
     client := &RPCClient{
         conn:       conn,
         reader:     bufio.NewReaderSize(conn, BuffSizeReader),
+        styp:       config.styp,
         serializer: serializer,
+        compress:   config.compress,
+        threshold:  config.threshold,
+        legacy:     config.legacy,
         pending:    make(map[uint16]*Call),
         shutdown:   make(chan struct{}),
     }
+    if config.creds != nil {
+        err = client.authenticate(config.creds, config.timeout)
+        if err != nil {
+            conn.Close()
+            return nil, fmt.Errorf("auth with rpc server<%v> error %v", addr, err)
+        }
+    }
 
     client.wg.Add(1)
     go client.input()
@@ -93,11 +259,67 @@ func newRPCClient(addr string, styp codec.SerializeType) *RPCClient {
     client.wg.Add(1)
     go client.heartbeat()
 
-    return client
+    return client, nil
+}
+
+func tlsHandshake(conn net.Conn, addr string, timeout time.Duration, config *tls.Config) (net.Conn, error) {
+    if config.ServerName == "" && !config.InsecureSkipVerify {
+        //按地址中的host校验服务端证书
+        scheme, address := transport.Split(addr)
+        if scheme == transport.SchemeTCP {
+            if host, _, err := net.SplitHostPort(address); err == nil {
+                config = config.Clone()
+                config.ServerName = host
+            }
+        }
+    }
+    tc := tls.Client(conn, config)
+    tc.SetDeadline(time.Now().Add(timeout))
+    if err := tc.Handshake(); err != nil {
+        conn.Close()
+        return nil, err
+    }
+    tc.SetDeadline(time.Time{})
+    return tc, nil
+}
+
+//发送凭证并等待服务端的认证结果，在收包协程启动之前进行
+func (rc *RPCClient) authenticate(provider auth.CredentialsProvider, timeout time.Duration) error {
+    creds, err := provider()
+    if err != nil {
+        return err
+    }
+    pkg := rc.newRequest(0, rc.styp)
+    rc.conn.SetDeadline(time.Now().Add(timeout))
+    defer rc.conn.SetDeadline(time.Time{})
+    if err = pkg.PackTo(rc.conn, auth.HandshakeMethod, creds, rc.serializer); err != nil {
+        return err
+    }
+    rmsg, err := message.NewResponse(rc.reader)
+    if err != nil {
+        return err
+    }
+    defer rmsg.Release()
+    if rmsg.ServiceMethod() != auth.HandshakeMethod {
+        return fmt.Errorf("unexpected handshake response %v", rmsg.ServiceMethod())
+    }
+    var errmsg string
+    if err = rmsg.Unpack(rc.serializer, &errmsg); err != nil {
+        return err
+    }
+    if errmsg != "" {
+        return errors.New(errmsg)
+    }
+    return nil
 }
 
 //同步阻塞调用
 func (rc *RPCClient) Call(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error {
+    return rc.callWith(ctx, rc.styp, serviceMethod, args, reply)
+}
+
+//指定本次调用的序列化方式，服务端以相同的方式返回
+func (rc *RPCClient) callWith(ctx context.Context, styp codec.SerializeType, serviceMethod string, args interface{}, reply interface{}) error {
     rc.mutex.Lock()
     rc.seq++
     if rc.seq == 0 {
@@ -105,7 +327,7 @@ func (rc *RPCClient) Call(ctx context.Context, serviceMethod string, args interf
     }
     seq := rc.seq
     rc.mutex.Unlock()
-    done := rc.doCall(seq, serviceMethod, args, reply)
+    done := rc.doCall(seq, styp, serviceMethod, args, reply)
     select {
     case <- rc.shutdown:
         log.Println("[prpc] call encounter shutdown")
@@ -131,7 +353,7 @@ func (rc *RPCClient) Go(ctx context.Context, serviceMethod string, args interfac
     }
     seq := rc.seq
     rc.mutex.Unlock()
-    done := rc.doCall(seq, serviceMethod, args, reply)
+    done := rc.doCall(seq, rc.styp, serviceMethod, args, reply)
     rc.wg.Add(1)
     go func() {
         defer rc.wg.Done()
@@ -177,13 +399,31 @@ func (rc *RPCClient) Close() error {
 
 //==========================================================================
 
-func (rc *RPCClient) doCall(seq uint16, serviceMethod string, args interface{}, reply interface{}) chan *Call {
+//尚未返回的请求数
+func (rc *RPCClient) pendingCount() int {
+    rc.mutex.Lock()
+    defer rc.mutex.Unlock()
+    return len(rc.pending)
+}
+
+func (rc *RPCClient) doCall(seq uint16, styp codec.SerializeType, serviceMethod string, args interface{}, reply interface{}) chan *Call {
     call := new(Call)
     call.ServiceMethod = serviceMethod
     call.Args = args
     call.Reply = reply
     call.Done = make(chan *Call, 10)
     call.Seq = seq
+    if rc.legacy {
+        //旧版本的服务端按自身的序列化方式解码，忽略本次调用指定的方式
+        styp = rc.styp
+    }
+    call.styp = styp
+    call.serializer = codec.GetSerializer(styp)
+    if call.serializer == nil {
+        call.Error = fmt.Errorf("styp %v not support", styp)
+        call.done()
+        return call.Done
+    }
     rc.send(call)
 
     return call.Done
@@ -205,27 +445,11 @@ func (rc *RPCClient) send(call *Call) {
 
     // Encode and send the request.
     //todo msg pool
-    pkg := message.NewRequest(message.MsgKindDefault, call.Seq)
-    data, err := pkg.Pack(call.ServiceMethod, call.Args, rc.serializer)
-    if err != nil {
-        //todo
-        log.Printf("[prpc][ERROR] pack error %v", err)
-        rc.mutex.Lock()
-        call = rc.pending[call.Seq]
-        delete(rc.pending, call.Seq)
-        rc.mutex.Unlock()
-        if call != nil {
-            call.Error = err
-            call.done()
-        }
-        return
-    }
-    //log.Printf("pack ok, data len %v", len(data))
-
+    pkg := rc.newRequest(call.Seq, call.styp)
     //todo write timeout SetWriteDeadline
-    _, err = rc.conn.Write(data)
+    err := pkg.PackTo(rc.conn, call.ServiceMethod, call.Args, call.serializer)
     if err != nil {
-        log.Printf("[prpc][ERROR] conn write error %v", err)
+        log.Printf("[prpc][ERROR] pack and write error %v", err)
         rc.mutex.Lock()
         call = rc.pending[call.Seq]
         delete(rc.pending, call.Seq)
@@ -240,6 +464,17 @@ func (rc *RPCClient) send(call *Call) {
     return
 }
 
+func (rc *RPCClient) newRequest(seq uint16, styp codec.SerializeType) *message.Message {
+    pkg := message.NewRequest(message.MsgKindDefault, seq)
+    if !rc.legacy {
+        //旧版本的包中没有序列化方式，SerializeTypeNone按旧版本打包
+        pkg.SetSerializeType(styp)
+    }
+    pkg.SetCompress(rc.compress, rc.threshold)
+    pkg.SetAcceptCompress(rc.compress)
+    return pkg
+}
+
 // 处理收包逻辑
 func (rc *RPCClient) input() {
     defer rc.wg.Done()
@@ -256,6 +491,19 @@ func (rc *RPCClient) input() {
         // read timeout SetReadDeadline
         rc.conn.SetReadDeadline(time.Now().Add(ReadTimeout))
         rmsg, err = message.NewResponse(rc.reader)
+        if berr, ok := err.(*message.BodyError); ok {
+            //包已完整读出，只有对应的调用失败
+            err = nil
+            rc.mutex.Lock()
+            call := rc.pending[rmsg.Seqno()]
+            delete(rc.pending, rmsg.Seqno())
+            rc.mutex.Unlock()
+            if call != nil {
+                call.Error = berr
+                call.done()
+            }
+            continue
+        }
         if err != nil {
             if err != io.EOF {
                 if strings.Contains(err.Error(), ErrNetClosing.Error()) {
@@ -290,14 +538,24 @@ func (rc *RPCClient) input() {
         case call == nil:
             // We've got no pending call.
             log.Printf("[prpc] rpc request seqno<%v> not found", seq)
+            rmsg.Release()
             continue
         default:
+            //服务端无法解析请求时返回的错误没有method，先于method检查
+            if code, errmsg := rmsg.RPCError(); code != message.ErrCodeNone {
+                rmsg.Release()
+                call.Error = rpcError(call.ServiceMethod, code, errmsg)
+                call.done()
+                continue
+            }
             if rmsg.ServiceMethod() != call.ServiceMethod {
+                rmsg.Release()
                 call.Error = fmt.Errorf("response method mismatch: %v %v"+rmsg.ServiceMethod(), call.ServiceMethod)
                 call.done()
                 continue
             }
-            err = rmsg.Unpack(rc.serializer, call.Reply)
+            err = rmsg.Unpack(call.serializer, call.Reply)
+            rmsg.Release()
             if err != nil {
                 call.Error = errors.New("unpacking body " + err.Error())
             }
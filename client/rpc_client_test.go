@@ -8,16 +8,22 @@ import (
 import (
     "testing"
     "github.com/philipyao/prpc/codec"
+    "bufio"
     "context"
     "fmt"
+    "net"
     "time"
+
+    "github.com/philipyao/prpc/message"
+    "github.com/philipyao/prpc/registry"
+    "github.com/philipyao/prpc/server"
 )
 
 func TestRPCCall(t *testing.T) {
     if true {
         return
     }
-    cli := newRPCClient("localhost:7881", codec.SerializeTypeMsgpack)
+    cli := newRPCClient("localhost:7881", &configDial{styp: codec.SerializeTypeMsgpack, timeout: DialTimeout})
     if cli == nil {
         t.Fatal("create rpc client error")
     }
@@ -36,7 +42,7 @@ func TestRPCGo(t *testing.T) {
     if true {
         return
     }
-    cli := newRPCClient("localhost:7881", codec.SerializeTypeMsgpack)
+    cli := newRPCClient("localhost:7881", &configDial{styp: codec.SerializeTypeMsgpack, timeout: DialTimeout})
     if cli == nil {
         t.Fatal("create rpc client error")
     }
@@ -64,7 +70,7 @@ func TestRPCGoCancell(t *testing.T) {
     if true {
         return
     }
-    cli := newRPCClient("localhost:7881", codec.SerializeTypeMsgpack)
+    cli := newRPCClient("localhost:7881", &configDial{styp: codec.SerializeTypeMsgpack, timeout: DialTimeout})
     if cli == nil {
         t.Fatal("create rpc client error")
     }
@@ -93,7 +99,7 @@ func TestRPCCallCancell(t *testing.T) {
     if true {
         return
     }
-    cli := newRPCClient("localhost:7881", codec.SerializeTypeMsgpack)
+    cli := newRPCClient("localhost:7881", &configDial{styp: codec.SerializeTypeMsgpack, timeout: DialTimeout})
     if cli == nil {
         t.Fatal("create rpc client error")
     }
@@ -116,3 +122,137 @@ func TestRPCCallCancell(t *testing.T) {
 
     time.Sleep(2 * time.Second)
 }
+
+func TestDial(t *testing.T) {
+    l := startFakeServer(t, 0)
+    defer l.Close()
+
+    cli, err := Dial(l.Addr().String(), WithDialSerialize(codec.SerializeTypeMsgpack), WithDialTimeout(time.Second))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer cli.Close()
+
+    var reply int
+    err = cli.Call(context.Background(), "Arith.Multiply", &Args{A: 2, B: 3}, &reply)
+    if err != nil || reply != 6 {
+        t.Fatalf("call: reply %v, err %v", reply, err)
+    }
+
+    done := make(chan error, 1)
+    var reply2 int
+    cli.Go(context.Background(), "Arith.Multiply", &Args{A: 4, B: 5}, &reply2, func(a interface{}, r interface{}, e error) {
+        done <- e
+    })
+    if err = <-done; err != nil || reply2 != 20 {
+        t.Fatalf("go: reply %v, err %v", reply2, err)
+    }
+
+    if _, err = Dial(l.Addr().String(), WithDialSerialize(codec.SerializeTypeNone)); err == nil {
+        t.Fatal("dial with unsupported serializer")
+    }
+}
+
+func TestCallWithSerialize(t *testing.T) {
+    srv := server.New("zone1001", 1, server.WithSerialize(codec.SerializeTypeProtobuf))
+    if err := srv.Handle(new(Identity), "Identity"); err == nil {
+        t.Fatal("non proto service handled on protobuf server")
+    }
+    if err := srv.Serve("127.0.0.1:0", nil); err != nil {
+        t.Fatal(err)
+    }
+    defer srv.Fini()
+
+    cli, err := Dial(srv.Addr().String(), WithDialSerialize(codec.SerializeTypeProtobuf))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer cli.Close()
+    //健康检查固定使用messagepack
+    var status string
+    err = cli.callWith(context.Background(), codec.SerializeTypeMsgpack, healthServiceMethod, "", &status)
+    if err != nil || status != healthServing {
+        t.Fatalf("health check on protobuf server: %v %v", status, err)
+    }
+    err = cli.callWith(context.Background(), codec.SerializeType(200), healthServiceMethod, "", &status)
+    if err == nil {
+        t.Fatal("call with unregistered serialize type")
+    }
+}
+
+//按节点注册的包格式版本打包，旧版本节点使用旧的包格式和节点的序列化方式
+func TestLegacyFrame(t *testing.T) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    styps := make(chan codec.SerializeType, 10)
+    go func() {
+        for {
+            conn, err := l.Accept()
+            if err != nil {
+                return
+            }
+            go func(conn net.Conn) {
+                defer conn.Close()
+                reader := bufio.NewReader(conn)
+                for {
+                    msg, err := message.NewResponse(reader)
+                    if err != nil {
+                        return
+                    }
+                    styp := msg.SerializeType()
+                    styps <- styp
+                    s := codec.GetSerializer(styp)
+                    if styp == codec.SerializeTypeNone {
+                        //旧版本服务端使用自身的序列化方式
+                        s = codec.GetSerializer(codec.SerializeTypeMsgpack)
+                    }
+                    var args Args
+                    if err = msg.Unpack(s, &args); err != nil {
+                        return
+                    }
+                    reply := message.NewRequest(message.MsgKindDefault, msg.Seqno())
+                    reply.SetSerializeType(styp)
+                    if err = reply.PackTo(conn, msg.ServiceMethod(), args.A*args.B, s); err != nil {
+                        return
+                    }
+                }
+            }(conn)
+        }
+    }()
+
+    sc := newSvcClient("Arith", "zone1001", nil)
+    for i, frame := range []int{0, message.FrameVersion} {
+        sc.addEndpoint([]*registry.Node{{
+            Path: fmt.Sprintf("node%v", i),
+            ID:   registry.ID{Group: "zone1001", Index: i},
+            Addr: l.Addr().String(),
+            NodeOption: &registry.NodeOption{
+                Weight: 10,
+                Styp:   int(codec.SerializeTypeMsgpack),
+                Frame:  frame,
+            },
+        }})
+    }
+    eps := sc.loadEndpoints()
+    if len(eps) != 2 {
+        t.Fatalf("unexpected endpoints %v", len(eps))
+    }
+    for _, ep := range eps {
+        defer ep.conn.Close()
+        var reply int
+        err = ep.conn.callWith(context.Background(), codec.SerializeTypeJson, "Arith.Multiply", &Args{A: 2, B: 3}, &reply)
+        if err != nil || reply != 6 {
+            t.Fatalf("call %v: reply %v, err %v", ep.key, reply, err)
+        }
+        expect := codec.SerializeTypeJson
+        if ep.frame == 0 {
+            expect = codec.SerializeTypeNone
+        }
+        if styp := <-styps; styp != expect {
+            t.Fatalf("%v received styp %v, expect %v", ep.key, styp, expect)
+        }
+    }
+}
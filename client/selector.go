@@ -4,10 +4,12 @@ import (
     "errors"
     "fmt"
     "math/rand"
+    "sync"
+    "sync/atomic"
     "time"
 )
 
-type selector func(endPoints []*endPoint) *endPoint
+type selector func(endPoints []*endPoint, call *callInfo) *endPoint
 type fnSelect func(config configSelect) (selector, error)
 
 func init() {
@@ -15,7 +17,7 @@ func init() {
 }
 
 func selectRandom(config configSelect) (selector, error) {
-    return func(endPoints []*endPoint) *endPoint {
+    return func(endPoints []*endPoint, call *callInfo) *endPoint {
         if len(endPoints) == 0 {
             return nil
         }
@@ -23,12 +25,52 @@ func selectRandom(config configSelect) (selector, error) {
     }, nil
 }
 
-//todo
-//func selectWeightedRoundrobin
+//平滑加权轮询，参考nginx的实现
 //https://github.com/phusion/nginx/commit/27e94984486058d73157038f7950a0a36ecc6e35
+//每轮每个节点的currentWeight加上自身权重，选出currentWeight最大的节点，再减去总权重。
+//权重在线更新时直接使用新权重，currentWeight会自行收敛；节点增删时新节点从0开始。
+func selectWeightedRoundRobin(config configSelect) (selector, error) {
+    var lock sync.Mutex
+    currents := make(map[string]int) //endpoint key -> currentWeight
+    return func(endPoints []*endPoint, call *callInfo) *endPoint {
+        lock.Lock()
+        defer lock.Unlock()
+
+        var best *endPoint
+        total := 0
+        for _, ep := range endPoints {
+            if ep.weight <= 0 {
+                continue
+            }
+            currents[ep.key] += ep.weight
+            total += ep.weight
+            if best == nil || currents[ep.key] > currents[best.key] {
+                best = ep
+            }
+        }
+        if best == nil {
+            return nil
+        }
+        currents[best.key] -= total
+
+        //清理已经不在候选列表中的节点
+        if len(currents) > len(endPoints) {
+            seen := make(map[string]struct{}, len(endPoints))
+            for _, ep := range endPoints {
+                seen[ep.key] = struct{}{}
+            }
+            for key := range currents {
+                if _, ok := seen[key]; !ok {
+                    delete(currents, key)
+                }
+            }
+        }
+        return best
+    }, nil
+}
 
 func selectWeightedRandom(config configSelect) (selector, error) {
-    return func(endPoints []*endPoint) *endPoint {
+    return func(endPoints []*endPoint, call *callInfo) *endPoint {
         total := 0
         for _, ep := range endPoints {
             total += ep.weight
@@ -50,14 +92,89 @@ func selectWeightedRandom(config configSelect) (selector, error) {
 }
 
 func selectRoundRobin(config configSelect) (selector, error) {
-    var i int
-    return func(endPoints []*endPoint) *endPoint {
+    var i uint64
+    return func(endPoints []*endPoint, call *callInfo) *endPoint {
         if len(endPoints) == 0 {
             return nil
         }
-        ep := endPoints[i%len(endPoints)]
-        i++
-        return ep
+        n := atomic.AddUint64(&i, 1) - 1
+        return endPoints[n%uint64(len(endPoints))]
+    }, nil
+}
+
+//选取进行中请求最少的节点，数量相同时随机
+func selectLeastActive(config configSelect) (selector, error) {
+    return func(endPoints []*endPoint, call *callInfo) *endPoint {
+        var best *endPoint
+        least, ties := 0, 0
+        for _, ep := range endPoints {
+            n := ep.pending()
+            switch {
+            case best == nil || n < least:
+                best, least, ties = ep, n, 1
+            case n == least:
+                //蓄水池抽样，等概率选取
+                ties++
+                if rand.Intn(ties) == 0 {
+                    best = ep
+                }
+            }
+        }
+        return best
+    }, nil
+}
+
+//power of two choices: 随机选两个节点，取peak EWMA开销较小的那个
+func selectPeakEWMA(config configSelect) (selector, error) {
+    return func(endPoints []*endPoint, call *callInfo) *endPoint {
+        switch len(endPoints) {
+        case 0:
+            return nil
+        case 1:
+            return endPoints[0]
+        }
+        i := rand.Intn(len(endPoints))
+        j := rand.Intn(len(endPoints) - 1)
+        if j >= i {
+            j++
+        }
+        a, b := endPoints[i], endPoints[j]
+        if b.cost() < a.cost() {
+            return b
+        }
+        return a
+    }, nil
+}
+
+//一致性hash：相同hash key的请求总是落在同一节点，节点增删时只有少量key重新映射；
+//没有提供hash key的请求随机选取。
+//环由完整的节点快照构建，节点不健康、熔断等临时不可用时不重建，查找时跳过
+func selectConsistentHash(config configSelect) (selector, error) {
+    var lock sync.Mutex
+    var ring *hashRing
+    return func(endPoints []*endPoint, call *callInfo) *endPoint {
+        if len(endPoints) == 0 {
+            return nil
+        }
+        if call == nil || call.hashKey == "" {
+            return endPoints[rand.Intn(len(endPoints))]
+        }
+        all := call.endPoints
+        if all == nil {
+            all = endPoints
+        }
+        lock.Lock()
+        if ring == nil || !ring.match(all) {
+            ring = newHashRing(all)
+        }
+        r := ring
+        lock.Unlock()
+
+        candidates := make(map[string]*endPoint, len(endPoints))
+        for _, ep := range endPoints {
+            candidates[ep.key] = ep
+        }
+        return r.get(call.hashKey, candidates)
     }, nil
 }
 
@@ -65,7 +182,7 @@ func selectSpecified(config configSelect) (selector, error) {
     if config.index < 0 {
         return nil, errors.New("index not specified")
     }
-    return func(endPoints []*endPoint) *endPoint {
+    return func(endPoints []*endPoint, call *callInfo) *endPoint {
         if config.index >= len(endPoints) {
             return nil
         }
@@ -80,6 +197,10 @@ const (
     SelectTypeWeightedRandom
     SelectTypeRoundRobin
     SelectTypeSpecified
+    SelectTypeWeightedRoundRobin
+    SelectTypeLeastActive
+    SelectTypePeakEWMA
+    SelectTypeConsistentHash
 )
 
 var selectors = []struct {
@@ -91,6 +212,10 @@ var selectors = []struct {
     {SelectTypeWeightedRandom, "SelectTypeWeightedRandom", selectWeightedRandom},
     {SelectTypeRoundRobin, "SelectTypeRoundRobin", selectRoundRobin},
     {SelectTypeSpecified, "SelectTypeSpecified", selectSpecified},
+    {SelectTypeWeightedRoundRobin, "SelectTypeWeightedRoundRobin", selectWeightedRoundRobin},
+    {SelectTypeLeastActive, "SelectTypeLeastActive", selectLeastActive},
+    {SelectTypePeakEWMA, "SelectTypePeakEWMA", selectPeakEWMA},
+    {SelectTypeConsistentHash, "SelectTypeConsistentHash", selectConsistentHash},
 }
 
 func createSelector(config configSelect) (selector, error) {
@@ -0,0 +1,124 @@
+package client
+
+import (
+    "errors"
+    "fmt"
+    "sync"
+    "time"
+)
+
+//节点的实时统计
+type EndpointStats struct {
+    CallTimes   uint32        //累计调用次数
+    Inflight    int           //进行中的调用数
+    Pending     int           //连接上尚未返回的请求数
+    Latency     time.Duration //peak EWMA 延迟
+    BreakerOpen bool          //是否已熔断
+}
+
+//节点信息，供自定义选择器使用
+type EndpointInfo struct {
+    Index   int
+    Weight  int
+    Version string
+    Addr    string
+    Labels  map[string]string //只读
+    Stats   EndpointStats
+}
+
+//调用上下文，供自定义选择器使用
+type CallContext struct {
+    Service       string
+    Group         string
+    ServiceMethod string
+    Args          interface{}
+    HashKey       string
+}
+
+//自定义选择器，返回选中节点在endpoints中的下标，没有合适的节点返回-1
+//同一个SvcClient的调用会并发地调用Select，实现需要自己保证并发安全
+type Selector interface {
+    Select(endpoints []EndpointInfo, call *CallContext) int
+}
+
+//每个SvcClient通过factory获得一个独立的Selector，以便各自维护状态
+type FnSelectorFactory func() Selector
+
+var (
+    customLock      sync.RWMutex
+    customSelectors = make(map[string]FnSelectorFactory)
+)
+
+//按名字注册自定义选择器，之后可通过 WithSelectorName 使用
+func RegisterSelector(name string, factory FnSelectorFactory) error {
+    if name == "" {
+        return errors.New("empty selector name")
+    }
+    if factory == nil {
+        return fmt.Errorf("nil factory for selector %v", name)
+    }
+    customLock.Lock()
+    defer customLock.Unlock()
+    if _, exist := customSelectors[name]; exist {
+        return fmt.Errorf("selector %v already registered", name)
+    }
+    customSelectors[name] = factory
+    return nil
+}
+
+func lookupSelector(name string) (FnSelectorFactory, error) {
+    customLock.RLock()
+    defer customLock.RUnlock()
+    factory, exist := customSelectors[name]
+    if !exist {
+        return nil, fmt.Errorf("selector %v not registered", name)
+    }
+    return factory, nil
+}
+
+//将自定义选择器适配为内部的selector
+func adaptSelector(s Selector, service, group string) selector {
+    return func(endPoints []*endPoint, call *callInfo) *endPoint {
+        if len(endPoints) == 0 {
+            return nil
+        }
+        infos := make([]EndpointInfo, len(endPoints))
+        for i, ep := range endPoints {
+            infos[i] = ep.info()
+        }
+        ctx := &CallContext{
+            Service: service,
+            Group:   group,
+        }
+        if call != nil {
+            ctx.ServiceMethod = call.serviceMethod
+            ctx.Args = call.args
+            ctx.HashKey = call.hashKey
+        }
+        i := s.Select(infos, ctx)
+        if i < 0 || i >= len(endPoints) {
+            return nil
+        }
+        return endPoints[i]
+    }
+}
+
+func (ep *endPoint) info() EndpointInfo {
+    info := EndpointInfo{
+        Index:   ep.index,
+        Weight:  ep.weight,
+        Version: ep.version,
+        Addr:    ep.addr,
+        Labels:  ep.labels,
+    }
+    ep.stats.lock.Lock()
+    info.Stats.CallTimes = ep.stats.callTimes
+    info.Stats.Inflight = ep.stats.inflight
+    info.Stats.Latency = time.Duration(ep.stats.ewma)
+    ep.stats.lock.Unlock()
+    info.Stats.Pending = ep.pending()
+    if ep.breaker != nil {
+        info.Stats.BreakerOpen = ep.breaker.currentState() == breakerOpen
+    }
+    return info
+}
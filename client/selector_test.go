@@ -0,0 +1,309 @@
+package client
+
+import (
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func makeEndpoints(weights ...int) []*endPoint {
+    var eps []*endPoint
+    for i, w := range weights {
+        eps = append(eps, &endPoint{
+            key:    fmt.Sprintf("/svc/g.%v", i+1),
+            index:  i + 1,
+            weight: w,
+            stats:  new(endpointStats),
+        })
+    }
+    return eps
+}
+
+func selectSequence(slt selector, eps []*endPoint, n int) []int {
+    var seq []int
+    for i := 0; i < n; i++ {
+        seq = append(seq, slt(eps, nil).index)
+    }
+    return seq
+}
+
+func TestSelectWeightedRoundRobin(t *testing.T) {
+    slt, err := createSelector(configSelect{typ: SelectTypeWeightedRoundRobin})
+    if err != nil {
+        t.Fatal(err)
+    }
+    eps := makeEndpoints(5, 1, 1)
+
+    //nginx平滑加权轮询的经典序列: a a b a c a a
+    expect := []int{1, 1, 2, 1, 3, 1, 1}
+    seq := selectSequence(slt, eps, len(expect))
+    if fmt.Sprint(seq) != fmt.Sprint(expect) {
+        t.Fatalf("unexpected sequence %v, expect %v", seq, expect)
+    }
+
+    //在线修改权重
+    eps[0].weight = 1
+    counts := make(map[int]int)
+    for _, idx := range selectSequence(slt, eps, 300) {
+        counts[idx]++
+    }
+    for idx, c := range counts {
+        if c < 99 || c > 101 {
+            t.Fatalf("endpoint %v selected %v times after weight update", idx, c)
+        }
+    }
+
+    //增删节点
+    eps = append(eps[1:], makeEndpoints(0, 0, 0, 2)[3])
+    counts = make(map[int]int)
+    for _, idx := range selectSequence(slt, eps, 400) {
+        counts[idx]++
+    }
+    if counts[1] != 0 || counts[2] != 100 || counts[3] != 100 || counts[4] != 200 {
+        t.Fatalf("unexpected distribution after endpoints change: %v", counts)
+    }
+
+    //权重全为0
+    if ep := slt(makeEndpoints(0, 0), nil); ep != nil {
+        t.Fatalf("zero weight endpoint selected: %+v", ep)
+    }
+}
+
+func TestSelectRoundRobinConcurrent(t *testing.T) {
+    slt, err := createSelector(configSelect{typ: SelectTypeRoundRobin})
+    if err != nil {
+        t.Fatal(err)
+    }
+    eps := makeEndpoints(1, 1, 1, 1)
+
+    var lock sync.Mutex
+    counts := make(map[int]int)
+    var wg sync.WaitGroup
+    for g := 0; g < 8; g++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := 0; i < 100; i++ {
+                ep := slt(eps, nil)
+                lock.Lock()
+                counts[ep.index]++
+                lock.Unlock()
+            }
+        }()
+    }
+    wg.Wait()
+    for idx, c := range counts {
+        if c != 200 {
+            t.Fatalf("endpoint %v selected %v times, expect 200", idx, c)
+        }
+    }
+}
+
+func TestSelectLeastActive(t *testing.T) {
+    slt, err := createSelector(configSelect{typ: SelectTypeLeastActive})
+    if err != nil {
+        t.Fatal(err)
+    }
+    eps := makeEndpoints(1, 1, 1)
+    for i, ep := range eps {
+        ep.conn = &RPCClient{pending: make(map[uint16]*Call)}
+        for seq := 0; seq < 3-i; seq++ {
+            ep.conn.pending[uint16(seq)] = new(Call)
+        }
+    }
+    for i := 0; i < 10; i++ {
+        if ep := slt(eps, nil); ep.index != 3 {
+            t.Fatalf("endpoint %v selected, expect the least active 3", ep.index)
+        }
+    }
+}
+
+func TestSelectPeakEWMA(t *testing.T) {
+    slt, err := createSelector(configSelect{typ: SelectTypePeakEWMA})
+    if err != nil {
+        t.Fatal(err)
+    }
+    eps := makeEndpoints(1, 1)
+    fast, slow := eps[0], eps[1]
+    fast.observe(time.Now().Add(-time.Millisecond))
+    slow.observe(time.Now().Add(-100 * time.Millisecond))
+    for i := 0; i < 10; i++ {
+        if ep := slt(eps, nil); ep != fast {
+            t.Fatalf("slow endpoint %v selected", ep.index)
+        }
+    }
+
+    //peak: 延迟突增立即生效
+    fast.observe(time.Now().Add(-time.Second))
+    if ep := slt(eps, nil); ep != slow {
+        t.Fatalf("endpoint %v selected after latency peak", ep.index)
+    }
+
+    //进行中的请求数也计入开销
+    cold := makeEndpoints(1)[0]
+    cold.acquire()
+    if cold.cost() <= slow.cost() {
+        t.Fatal("cold endpoint with inflight calls should be penalized")
+    }
+}
+
+func TestSelectConsistentHash(t *testing.T) {
+    slt, err := createSelector(configSelect{typ: SelectTypeConsistentHash})
+    if err != nil {
+        t.Fatal(err)
+    }
+    eps := makeEndpoints(10, 10, 10, 10)
+    const keys = 10000
+    mapping := make(map[string]int)
+    counts := make(map[int]int)
+    for i := 0; i < keys; i++ {
+        key := fmt.Sprintf("player%v", i)
+        idx := slt(eps, &callInfo{hashKey: key}).index
+        mapping[key] = idx
+        counts[idx]++
+        //相同的key总是选到相同节点
+        if slt(eps, &callInfo{hashKey: key}).index != idx {
+            t.Fatalf("key %v not sticky", key)
+        }
+    }
+    for idx, c := range counts {
+        if c < keys/4*7/10 || c > keys/4*13/10 {
+            t.Fatalf("unbalanced distribution: endpoint %v got %v keys", idx, c)
+        }
+    }
+
+    //新增节点只影响大约1/5的key
+    eps = append(eps, makeEndpoints(10, 10, 10, 10, 10)[4])
+    moved := 0
+    for key, idx := range mapping {
+        nidx := slt(eps, &callInfo{hashKey: key}).index
+        if nidx != idx {
+            if nidx != 5 {
+                t.Fatalf("key %v moved between existing endpoints: %v -> %v", key, idx, nidx)
+            }
+            moved++
+        }
+    }
+    if moved < keys/5*7/10 || moved > keys/5*13/10 {
+        t.Fatalf("%v keys remapped after adding endpoint", moved)
+    }
+
+    //删除节点只影响该节点上的key
+    eps = eps[1:]
+    for key, idx := range mapping {
+        nidx := slt(eps, &callInfo{hashKey: key}).index
+        if idx != 1 && nidx != idx && nidx != 5 {
+            t.Fatalf("key %v moved after removing endpoint: %v -> %v", key, idx, nidx)
+        }
+    }
+
+    //权重越大，分到的key越多
+    eps = makeEndpoints(10, 30)
+    counts = make(map[int]int)
+    for i := 0; i < keys; i++ {
+        counts[slt(eps, &callInfo{hashKey: fmt.Sprintf("room%v", i)}).index]++
+    }
+    if counts[2] < counts[1]*2 {
+        t.Fatalf("weight not respected: %v", counts)
+    }
+
+    //没有hash key时随机选取
+    if ep := slt(eps, &callInfo{}); ep == nil {
+        t.Fatal("no endpoint selected without hash key")
+    }
+}
+
+//节点临时不可用时跳过，其他节点上的key不受影响，恢复后key回到原节点
+func TestConsistentHashUnavailable(t *testing.T) {
+    sc := newSvcClient("Arith", "zone1001", nil, WithVersionAll(), WithSelectType(SelectTypeConsistentHash))
+    eps := makeEndpoints(10, 10, 10, 10)
+    for _, ep := range eps {
+        ep.breaker = newCircuitBreaker(&sc.breakerConfig)
+    }
+    sc.endPoints.Store(eps)
+
+    const keys = 1000
+    selectKey := func(key string) int {
+        ep, err := sc.selectEndpoint(sc.loadEndpoints(), &callInfo{hashKey: key})
+        if err != nil {
+            t.Fatal(err)
+        }
+        return ep.index
+    }
+    mapping := make(map[string]int)
+    for i := 0; i < keys; i++ {
+        key := fmt.Sprintf("player%v", i)
+        mapping[key] = selectKey(key)
+    }
+
+    eps[1].stats.unhealthy = true
+    for key, idx := range mapping {
+        nidx := selectKey(key)
+        if nidx == eps[1].index {
+            t.Fatalf("key %v selected unhealthy endpoint", key)
+        }
+        if idx != eps[1].index && nidx != idx {
+            t.Fatalf("key %v moved while another endpoint unhealthy: %v -> %v", key, idx, nidx)
+        }
+    }
+
+    eps[1].stats.unhealthy = false
+    for key, idx := range mapping {
+        if nidx := selectKey(key); nidx != idx {
+            t.Fatalf("key %v not back after recovery: %v -> %v", key, idx, nidx)
+        }
+    }
+}
+
+//选择版本最高的节点
+type newestSelector struct {
+    calls int64
+}
+
+func (ns *newestSelector) Select(endpoints []EndpointInfo, call *CallContext) int {
+    atomic.AddInt64(&ns.calls, 1)
+    best := -1
+    for i, info := range endpoints {
+        if best < 0 || info.Version > endpoints[best].Version {
+            best = i
+        }
+    }
+    return best
+}
+
+func init() {
+    RegisterSelector("newest", func() Selector { return new(newestSelector) })
+}
+
+func TestCustomSelector(t *testing.T) {
+    factory := func() Selector { return new(newestSelector) }
+    if err := RegisterSelector("newest", factory); err == nil {
+        t.Fatal("duplicated selector registered")
+    }
+
+    sc := newSvcClient("Arith", "zone1001", nil, WithSelectorName("newest"))
+    if sc == nil {
+        t.Fatal("new service client with named selector failed")
+    }
+    eps := makeEndpoints(10, 10, 10)
+    eps[0].version, eps[1].version, eps[2].version = "v1.0", "v1.2", "v1.1"
+    if ep := sc.selector(eps, &callInfo{serviceMethod: "Multiply"}); ep != eps[1] {
+        t.Fatalf("unexpected endpoint selected: %+v", ep)
+    }
+    if ep := sc.selector(nil, nil); ep != nil {
+        t.Fatalf("endpoint selected from empty list: %+v", ep)
+    }
+
+    if sc := newSvcClient("Arith", "zone1001", nil, WithSelectorName("unknown")); sc != nil {
+        t.Fatal("unregistered selector accepted")
+    }
+    sc1 := newSvcClient("Arith", "zone1001", nil, WithSelector(new(newestSelector)))
+    sc2 := newSvcClient("Arith", "zone1001", nil, WithSelector(new(newestSelector)))
+    id1, _ := sc1.hashCode()
+    id2, _ := sc2.hashCode()
+    if id1 == id2 {
+        t.Fatal("services with different selector instances considered the same")
+    }
+}
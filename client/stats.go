@@ -0,0 +1,110 @@
+package client
+
+import (
+    "log"
+    "math"
+    "sync"
+    "time"
+)
+
+const (
+    //peak EWMA 的衰减时间常数
+    ewmaDecay = 10 * time.Second
+    //尚无延迟样本且有请求进行中时的惩罚开销，避免新节点被瞬间打满
+    ewmaPenalty = float64(math.MaxInt32) * float64(time.Millisecond)
+)
+
+//endpoint的运行时统计，节点数据更新生成新的endPoint时沿用
+type endpointStats struct {
+    lock      sync.Mutex //protect following
+    callTimes uint32
+    inflight  int       //进行中的调用数
+    retired   bool      //节点已删除，等进行中的调用结束后关闭连接
+    unhealthy bool      //主动健康检查失败
+    ewma      float64   //peak EWMA 延迟(ns)
+    ewmaStamp time.Time //上次更新ewma的时间
+}
+
+//占用节点，节点已被删除时返回false
+func (ep *endPoint) acquire() bool {
+    ep.stats.lock.Lock()
+    defer ep.stats.lock.Unlock()
+    if ep.stats.retired {
+        return false
+    }
+    ep.stats.inflight++
+    return true
+}
+
+//释放节点，已删除的节点在最后一个调用结束后关闭连接
+func (ep *endPoint) release() {
+    ep.stats.lock.Lock()
+    ep.stats.inflight--
+    closing := ep.stats.retired && ep.stats.inflight == 0
+    ep.stats.lock.Unlock()
+    if closing {
+        go ep.close()
+    }
+}
+
+//节点被删除，不再接受新的调用
+func (ep *endPoint) retire() {
+    ep.stats.lock.Lock()
+    ep.stats.retired = true
+    closing := ep.stats.inflight == 0
+    ep.stats.lock.Unlock()
+    if closing {
+        ep.close()
+    }
+}
+
+func (ep *endPoint) close() {
+    if ep.conn == nil {
+        return
+    }
+    err := ep.conn.Close()
+    if err != nil {
+        log.Printf("[prpc][ERROR] close endpoint<%v> conn: %v", ep.key, err)
+    }
+}
+
+//调用结束，更新调用次数和peak EWMA延迟
+func (ep *endPoint) observe(start time.Time) {
+    now := time.Now()
+    rtt := float64(now.Sub(start))
+
+    ep.stats.lock.Lock()
+    defer ep.stats.lock.Unlock()
+    ep.stats.callTimes++
+    switch {
+    case ep.stats.ewma == 0 || rtt > ep.stats.ewma:
+        //peak: 延迟变大时立即生效
+        ep.stats.ewma = rtt
+    default:
+        elapsed := float64(now.Sub(ep.stats.ewmaStamp))
+        if elapsed < 0 {
+            elapsed = 0
+        }
+        w := math.Exp(-elapsed / float64(ewmaDecay))
+        ep.stats.ewma = ep.stats.ewma*w + rtt*(1-w)
+    }
+    ep.stats.ewmaStamp = now
+}
+
+//负载开销: 延迟 * (进行中的调用数 + 1)
+func (ep *endPoint) cost() float64 {
+    ep.stats.lock.Lock()
+    defer ep.stats.lock.Unlock()
+    if ep.stats.ewma == 0 && ep.stats.inflight > 0 {
+        return ewmaPenalty + float64(ep.stats.inflight)
+    }
+    return ep.stats.ewma * float64(ep.stats.inflight+1)
+}
+
+//连接上尚未返回的请求数
+func (ep *endPoint) pending() int {
+    if ep.conn == nil {
+        return 0
+    }
+    return ep.conn.pendingCount()
+}
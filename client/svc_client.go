@@ -3,16 +3,21 @@ package client
 import (
     "bytes"
     "crypto/sha256"
+    "crypto/tls"
     "encoding/binary"
     "errors"
     "fmt"
+    "github.com/philipyao/prpc/auth"
     "github.com/philipyao/prpc/codec"
+    "github.com/philipyao/prpc/compress"
+    "github.com/philipyao/prpc/message"
     "github.com/philipyao/prpc/registry"
-    "github.com/afex/hystrix-go/hystrix"
     "log"
     "sync"
+    "sync/atomic"
     "context"
     "reflect"
+    "time"
 )
 
 const (
@@ -24,19 +29,44 @@ type Args struct {
     A, B int
 }
 
+//endPoint创建后只读，节点数据变化时生成新的endPoint替换旧的，
+//连接、熔断器和运行时统计在新旧endPoint之间共享
 type endPoint struct {
     key string
 
-    index   int
-    weight  int
-    version string
-    styp    codec.SerializeType
-    addr    string
-    conn    *RPCClient
+    index    int
+    weight   int
+    version  string
+    disabled bool              //服务方禁用，不参与选取
+    labels   map[string]string //节点标签，只读
+    styp     codec.SerializeType
+    addr     string
+    tls      bool     //节点只接受TLS连接
+    compress []string //节点支持的压缩方式
+    frame    int      //节点支持的包格式版本
+    conn     *RPCClient
+    breaker  *circuitBreaker  //熔断器
+    outlier  *outlierDetector //异常检测，未开启时为nil
+    stats    *endpointStats
+}
 
-    lock sync.Mutex         //protect following
-    callTimes uint32
-    //failtimes
+func newEndpoint(node *registry.Node, config *BreakerConfig, oconfig *OutlierConfig) *endPoint {
+    return &endPoint{
+        key:      node.Path,
+        index:    node.ID.Index,
+        weight:   node.Weight,
+        version:  node.Version,
+        disabled: node.Disabled,
+        labels:   node.Labels,
+        styp:     codec.SerializeType(node.Styp),
+        addr:     node.Addr,
+        tls:      node.TLS,
+        compress: node.Compress,
+        frame:    node.Frame,
+        breaker:  newCircuitBreaker(config),
+        outlier:  newOutlierDetector(oconfig),
+        stats:    new(endpointStats),
+    }
 }
 
 //检查注册中心的数据发生变化后，可变数据(可在线更新的)是否发生改变
@@ -44,13 +74,28 @@ type endPoint struct {
 //如果服务提供方的styp addr要修改，肯定会停掉服务，修改然后重新注册的，不会走到这里
 func (ep *endPoint) equalTo(node *registry.Node) bool {
     return ep.weight == node.Weight &&
-        ep.version == node.Version
+        ep.version == node.Version &&
+        ep.disabled == node.Disabled &&
+        equalLabels(ep.labels, node.Labels)
+}
+
+//根据可变数据(可在线更新的)生成新的endPoint
+func (ep *endPoint) update(node *registry.Node) *endPoint {
+    nep := *ep
+    nep.weight = node.Weight
+    nep.version = node.Version
+    nep.disabled = node.Disabled
+    nep.labels = node.Labels
+    return &nep
 }
 
-//更新可变数据(可在线更新的)
-func (ep *endPoint) update(node *registry.Node) {
-    ep.weight = node.Weight
-    ep.version = node.Version
+//一次调用的上下文，供selector选取节点
+type callInfo struct {
+    serviceMethod string
+    args          interface{}
+    hashKey       string //一致性hash的key
+
+    endPoints []*endPoint //过滤前的节点快照，一致性hash据此构建环
 }
 
 type SvcClient struct {
@@ -58,20 +103,42 @@ type SvcClient struct {
     service string
 
     //options
-    version    string     //选择特定版本
-    index      int        //选择特定index的endpoint
-    selectType selectType //选取算法
+    version     string       //选择特定版本
+    versionRule *versionRule //按版本分流的规则，优先于version
+    routeRule   *routeRule   //按标签路由的规则
+    index       int          //选择特定index的endpoint
+    selectType  selectType   //选取算法
 
     selector  selector //选择器
-    endPoints []*endPoint
+    custom    Selector //自定义选择器，优先于selectType
+    customID  string   //自定义选择器的标识，参与hashCode
+
+    epLock    sync.Mutex   //serialize endpoints writers
+    endPoints atomic.Value //[]*endPoint, copy-on-write snapshot
+
+    breakerConfig BreakerConfig //熔断配置，每个endpoint独立熔断
+
+    tlsConfig *tls.Config              //连接TLS节点时使用，nil表示使用系统根证书
+    creds     auth.CredentialsProvider //连接建立后发送的凭证
+
+    compress          compress.Kind //首选的压缩方式，节点不支持时使用gzip
+    compressThreshold int
+
+    outlierConfig *OutlierConfig //被动健康检查配置，nil表示不开启
+    outlierHook   FnOutlierHook  //节点摘除、恢复的回调
+    outlierLock   sync.Mutex     //serialize ejections
+
+    healthInterval time.Duration //主动健康检查间隔，0表示不开启
+    healthTimeout  time.Duration //健康检查超时
 
-    //断路器是否初始化: command -> isInit
-    breakerLock sync.RWMutex
-    breakers map[string]bool
+    exit chan struct{}
+    once sync.Once
+    wg   sync.WaitGroup
 
     statLock sync.Mutex
     reqTimes uint64
     succTimes uint64
+    pending   int //正在进行中的调用数
 
     registry *registry.Registry
 }
@@ -86,9 +153,34 @@ func (sc *SvcClient) Subscribe() error {
     if len(nodes) > 0 {
         sc.addEndpoint(nodes)
     }
+    if sc.healthInterval > 0 {
+        sc.wg.Add(1)
+        go sc.healthCheck()
+    }
     return nil
 }
 func (sc *SvcClient) Call(serviceMethod string, args interface{}, reply interface{}) error {
+    call := &callInfo{
+        serviceMethod: serviceMethod,
+        args:          args,
+    }
+    if hk, ok := args.(HashKeyer); ok {
+        call.hashKey = hk.HashKey()
+    }
+    return sc.call(call, reply)
+}
+
+//指定一致性hash的key来调用，优先于args实现的HashKeyer
+func (sc *SvcClient) CallWithHashKey(hashKey, serviceMethod string, args interface{}, reply interface{}) error {
+    call := &callInfo{
+        serviceMethod: serviceMethod,
+        args:          args,
+        hashKey:       hashKey,
+    }
+    return sc.call(call, reply)
+}
+
+func (sc *SvcClient) call(call *callInfo, reply interface{}) error {
     val := reflect.ValueOf(reply)
     if val.Kind() != reflect.Ptr || val.IsNil(){
         return errors.New("reply should be pointer and not nil")
@@ -103,109 +195,185 @@ func (sc *SvcClient) Call(serviceMethod string, args interface{}, reply interfac
 
     sc.statLock.Lock()
     sc.reqTimes++
-    sc.statLock.Unlock()
-
-    //初始化熔断器
-    breakerName := fmt.Sprintf("%v-%v-%v", sc.group, sc.service, serviceMethod)
-    sc.breakerLock.RLock()
-    _, exist := sc.breakers[breakerName];
-    sc.breakerLock.RUnlock()
-    if  !exist {
-        hystrix.ConfigureCommand(breakerName, hystrix.CommandConfig{
-            Timeout:                2000,       //函数执行2s超时
-            MaxConcurrentRequests:  50000,        //QPS
-            SleepWindow:            5000,       //5s
-            RequestVolumeThreshold: 10,
-            ErrorPercentThreshold:  20,         //20%
-        })
-        sc.breakerLock.Lock()
-        sc.breakers[breakerName] = true
-        sc.breakerLock.Unlock()
+    if sc.pending >= sc.breakerConfig.MaxConcurrentRequests {
+        sc.statLock.Unlock()
+        return ErrMaxConcurrency
     }
+    sc.pending++
+    sc.statLock.Unlock()
+    defer func() {
+        sc.statLock.Lock()
+        sc.pending--
+        sc.statLock.Unlock()
+    }()
 
-    // 加断路器来调用run函数：控制超时，错误熔断，提供过载保护
-    output := make(chan error, 1)
-    errors := hystrix.Go(breakerName, func() error {
-        output <- sc.doCall(serviceMethod, args, reply)
-        return nil
-    }, func(e error) error {
-        log.Printf("[prpc][ERROR] In fallback function for breaker %v, error: %v", breakerName, e.Error())
-        circuit, _, _ := hystrix.GetCircuit(breakerName)
-        log.Printf("[prpc][ERROR] Circuit state is: %v", circuit.IsOpen())
-        return e
-    })
-    // Response and error handling. If the call was successful, the output channel gets the response. Otherwise,
-    // the errors channel gives us the error.
-    // blocking wait here
-    select {
-    case out := <-output:
+    // 控制超时，熔断由各个endpoint的断路器负责
+    ctx, cancel := context.WithTimeout(context.Background(), sc.breakerConfig.Timeout)
+    defer cancel()
+    err := sc.doCall(ctx, call, reply)
+    if err == nil {
         sc.statLock.Lock()
         sc.succTimes++
         sc.statLock.Unlock()
-        return out
-    case err := <-errors:
+    }
+    return err
+}
+
+func (sc *SvcClient) doCall(ctx context.Context, call *callInfo, reply interface{}) error {
+    ep, err := sc.pick(call)
+    if err != nil {
         return err
     }
+    defer ep.release()
+
+    oprobe, ok := ep.outlier.allow()
+    if !ok {
+        return ErrEndpointEjected
+    }
+    probe, ok := ep.breaker.allow()
+    if !ok {
+        if oprobe {
+            ep.outlier.cancelProbe()
+        }
+        return ErrBreakerOpen
+    }
+    //调用中panic时也要上报结果，否则半开探测名额不会归还
+    succ := false
+    defer func() {
+        ep.breaker.done(probe, succ)
+        sc.reportOutlier(ep, oprobe, succ)
+        if !succ && !probe && ep.breaker.currentState() == breakerOpen {
+            log.Printf("[prpc][ERROR] endpoint<%v> circuit breaker open, last error: %v", ep.key, err)
+        }
+    }()
+    //todo failover机制
+    retry := 1
+    for retry > 0 {
+        start := time.Now()
+        smethod := fmt.Sprintf("%v.%v", sc.service, call.serviceMethod)
+        err = ep.conn.Call(ctx, smethod, call.args, reply)
+        ep.observe(start)
+        if err == nil {
+            break
+        }
+        retry--
+    }
+    //服务端返回的业务错误不计入节点故障
+    succ = err == nil || isServerError(err)
+    return err
 }
 
-func (sc *SvcClient) doCall(serviceMethod string, args interface{}, reply interface{}) error {
+//选取节点并占用，调用结束后需要release
+func (sc *SvcClient) pick(call *callInfo) (*endPoint, error) {
+    for {
+        ep, err := sc.selectEndpoint(sc.loadEndpoints(), call)
+        if err != nil {
+            return nil, err
+        }
+        //节点在选取之后被删除，从最新的快照中重新选取
+        if ep.acquire() {
+            return ep, nil
+        }
+    }
+}
+
+func (sc *SvcClient) selectEndpoint(endPoints []*endPoint, call *callInfo) (*endPoint, error) {
     var ep *endPoint
     if sc.index >= 0 {
         //指定固定的index
-        for _, e := range sc.endPoints {
+        for _, e := range endPoints {
             if e.index == sc.index {
                 ep = e
                 break
             }
         }
         if ep == nil {
-            return fmt.Errorf("specified index %v not exist", sc.index)
+            return nil, fmt.Errorf("specified index %v not exist", sc.index)
         }
-    } else {
-        //selector选取算法来选择节点
-        var eps []*endPoint
-
-        //1）如果指定了版本，先根据版本过滤可用的节点
-        if sc.version != noSpecifiedVersion {
-            for _, v := range sc.endPoints {
-                if sc.version != v.version {
-                    continue
-                }
-                eps = append(eps, v)
-            }
-        } else {
-            eps = sc.endPoints
+        return ep, nil
+    }
+
+    //selector选取算法来选择节点
+    if call != nil {
+        call.endPoints = endPoints
+    }
+    //1)先过滤掉禁用、不健康、已摘除、已熔断的节点，再按版本选取，
+    //所选版本没有可用节点时(如灰度节点被禁用)回退到缺省版本
+    //版本路由只选取一次，返回的原因与实际选取的版本一致
+    route := sc.versionRoute(call)
+    avail, _, _ := filterAvailable(endPoints)
+    eps := sc.matchRoute(avail, route)
+    if len(eps) == 0 {
+        //版本匹配的节点都不可用，返回具体原因
+        _, tripped, ejected := filterAvailable(sc.matchRoute(endPoints, route))
+        if tripped > 0 {
+            return nil, ErrBreakerOpen
+        }
+        if ejected > 0 {
+            return nil, ErrEndpointEjected
+        }
+        if route != nil {
+            return nil, fmt.Errorf("no available rpc servers for version %v", route)
         }
-        //2)selector选取节点
-        if len(eps) > 0 {
-            ep = sc.selector(eps)
+        return nil, errors.New("no available rpc servers")
+    }
+    //2)按标签路由规则逐级筛选
+    if sc.routeRule != nil {
+        eps = sc.routeRule.pick(eps)
+        if len(eps) == 0 {
+            return nil, errors.New("no rpc servers match route rule")
         }
     }
+    //3)selector选取节点
+    ep = sc.selector(eps, call)
     if ep == nil {
         //todo
-        return errors.New("no available rpc servers")
+        return nil, errors.New("no available rpc servers")
     }
-    //todo failover机制
-    retry := 1
-    var err error
-    for retry > 0 {
-        ep.lock.Lock()
-        ep.callTimes++
-        ep.lock.Unlock()
-        smethod := fmt.Sprintf("%v.%v", sc.service, serviceMethod)
-        err = ep.conn.Call(context.Background(), smethod, args, reply)
-        if err == nil {
-            break
+    return ep, nil
+}
+
+//可以参与选取的节点，同时返回已熔断、已摘除的节点数；禁用和不健康的节点直接忽略
+func filterAvailable(endPoints []*endPoint) (eps []*endPoint, tripped, ejected int) {
+    for _, ep := range endPoints {
+        if ep.disabled || !ep.healthy() {
+            continue
         }
-        retry--
+        if !ep.outlier.ready() {
+            ejected++
+            continue
+        }
+        if !ep.breaker.ready() {
+            tripped++
+            continue
+        }
+        eps = append(eps, ep)
     }
-    return err
+    return eps, tripped, ejected
 }
 
 func (sc *SvcClient) setVersion(v string) {
     sc.version = v
 }
 
+func (sc *SvcClient) setVersionRule(text string) error {
+    rule, err := parseVersionRule(text)
+    if err != nil {
+        return err
+    }
+    sc.versionRule = rule
+    return nil
+}
+
+func (sc *SvcClient) setRouteRule(text string) error {
+    rule, err := parseRouteRule(text)
+    if err != nil {
+        return err
+    }
+    sc.routeRule = rule
+    return nil
+}
+
 func (sc *SvcClient) setIndex(index int) error {
     if index < 0 {
         return errors.New("negtive index not allowed")
@@ -215,13 +383,57 @@ func (sc *SvcClient) setIndex(index int) error {
 }
 
 func (sc *SvcClient) setSelectType(styp selectType) error {
-    if int(styp) < 0 || int(styp) > len(selectors) {
+    if int(styp) < 0 || int(styp) >= len(selectors) {
         return fmt.Errorf("select type %v not support", styp)
     }
     sc.selectType = styp
     return nil
 }
 
+func (sc *SvcClient) setSelector(s Selector, id string) error {
+    if s == nil {
+        return errors.New("nil selector")
+    }
+    if id == "" {
+        //未命名的选择器以实例区分
+        id = fmt.Sprintf("%T", s)
+        if val := reflect.ValueOf(s); val.Kind() == reflect.Ptr {
+            id = fmt.Sprintf("%v@%x", id, val.Pointer())
+        }
+    }
+    sc.custom = s
+    sc.customID = id
+    return nil
+}
+
+func (sc *SvcClient) setOutlierDetection(config OutlierConfig, hook FnOutlierHook) error {
+    err := config.check()
+    if err != nil {
+        return err
+    }
+    sc.outlierConfig = &config
+    sc.outlierHook = hook
+    return nil
+}
+
+func (sc *SvcClient) setHealthCheck(interval, timeout time.Duration) error {
+    if interval <= 0 || timeout <= 0 {
+        return errors.New("health check interval and timeout should be positive")
+    }
+    sc.healthInterval = interval
+    sc.healthTimeout = timeout
+    return nil
+}
+
+func (sc *SvcClient) setBreakerConfig(config BreakerConfig) error {
+    err := config.check()
+    if err != nil {
+        return err
+    }
+    sc.breakerConfig = config
+    return nil
+}
+
 func (sc *SvcClient) decorate(opts ...fnOptionService) error {
     for n, fnOpt := range opts {
         if fnOpt == nil {
@@ -235,45 +447,159 @@ func (sc *SvcClient) decorate(opts ...fnOptionService) error {
     return nil
 }
 
+//节点要求TLS时的连接配置，非TLS节点返回nil
+func (sc *SvcClient) endpointTLS(ep *endPoint) *tls.Config {
+    if !ep.tls {
+        return nil
+    }
+    if sc.tlsConfig != nil {
+        return sc.tlsConfig
+    }
+    return new(tls.Config)
+}
+
+func (sc *SvcClient) setTLSConfig(config *tls.Config) error {
+    if config == nil {
+        return errors.New("nil tls config")
+    }
+    sc.tlsConfig = config
+    return nil
+}
+
+//节点支持首选的压缩方式时使用，否则使用所有版本都支持的gzip
+func (sc *SvcClient) endpointCompress(ep *endPoint) compress.Kind {
+    if sc.compress == compress.None || sc.compress == compress.Gzip {
+        return sc.compress
+    }
+    for _, name := range ep.compress {
+        if kind, ok := compress.Lookup(name); ok && kind == sc.compress {
+            return sc.compress
+        }
+    }
+    return compress.Gzip
+}
+
+func (sc *SvcClient) setCompress(kind compress.Kind, threshold int) error {
+    if kind != compress.None && compress.Get(kind) == nil {
+        return &compress.UnsupportedError{Kind: kind}
+    }
+    sc.compress = kind
+    sc.compressThreshold = threshold
+    return nil
+}
+
+func (sc *SvcClient) setCredentials(creds auth.CredentialsProvider) error {
+    if creds == nil {
+        return errors.New("nil credentials provider")
+    }
+    sc.creds = creds
+    return nil
+}
+
+//当前的endpoints快照，只读
+func (sc *SvcClient) loadEndpoints() []*endPoint {
+    eps, _ := sc.endPoints.Load().([]*endPoint)
+    return eps
+}
+
 func (sc *SvcClient) addEndpoint(nodes []*registry.Node) {
+    //连接在锁外建立
+    var adds []*endPoint
     for _, node := range nodes {
-        ep := &endPoint{
-            key:     node.Path,
-            index:   node.ID.Index,
-            weight:  node.Weight,
-            version: node.Version,
-            styp:    codec.SerializeType(node.Styp),
-            addr:    node.Addr,
-        }
-        rpc := newRPCClient(ep.addr, ep.styp)
+        ep := newEndpoint(node, &sc.breakerConfig, sc.outlierConfig)
+        rpc := newRPCClient(ep.addr, &configDial{
+            styp:      ep.styp,
+            timeout:   DialTimeout,
+            tlsConfig: sc.endpointTLS(ep),
+            creds:     sc.creds,
+            compress:  sc.endpointCompress(ep),
+            threshold: sc.compressThreshold,
+            legacy:    ep.frame < message.FrameVersion,
+        })
         if rpc == nil {
             continue
         }
         ep.conn = rpc
-        sc.endPoints = append(sc.endPoints, ep)
-        log.Printf("[prpc] service<%v> add endpoint: %+v, total %v\n", sc.service, ep, len(sc.endPoints))
+        adds = append(adds, ep)
+    }
+    if len(adds) == 0 {
+        return
+    }
+
+    sc.epLock.Lock()
+    defer sc.epLock.Unlock()
+    old := sc.loadEndpoints()
+    eps := make([]*endPoint, 0, len(old)+len(adds))
+    var replaced []*endPoint
+    for _, ep := range old {
+        dup := false
+        for _, add := range adds {
+            if add.key == ep.key {
+                dup = true
+                break
+            }
+        }
+        if dup {
+            replaced = append(replaced, ep)
+            continue
+        }
+        eps = append(eps, ep)
+    }
+    eps = append(eps, adds...)
+    sc.endPoints.Store(eps)
+    for _, ep := range adds {
+        log.Printf("[prpc] service<%v> add endpoint: %+v, total %v\n", sc.service, ep, len(eps))
+    }
+    //同一节点重复添加，旧连接在调用结束后关闭
+    for _, ep := range replaced {
+        ep.retire()
     }
 }
 
 func (sc *SvcClient) delEndpoint(dels []string) {
-    for _, del := range dels {
-        for i, ep := range sc.endPoints {
-            if del == ep.key {
-                sc.endPoints = append(sc.endPoints[:i], sc.endPoints[i+1:]...)
-                log.Printf("[prpc] delete endpoint %+v, total %v\n", ep, len(sc.endPoints))
+    sc.epLock.Lock()
+    defer sc.epLock.Unlock()
+    old := sc.loadEndpoints()
+    eps := make([]*endPoint, 0, len(old))
+    var removed []*endPoint
+    for _, ep := range old {
+        del := false
+        for _, key := range dels {
+            if key == ep.key {
+                del = true
                 break
             }
         }
+        if del {
+            removed = append(removed, ep)
+            continue
+        }
+        eps = append(eps, ep)
+    }
+    if len(removed) == 0 {
+        return
+    }
+    sc.endPoints.Store(eps)
+    //先替换快照，新的调用不会再选到被删除的节点，进行中的调用结束后关闭连接
+    for _, ep := range removed {
+        log.Printf("[prpc] delete endpoint %+v, total %v\n", ep, len(eps))
+        ep.retire()
     }
 }
 
 func (sc *SvcClient) updateEndpoint(node *registry.Node) {
-    for _, ep := range sc.endPoints {
+    sc.epLock.Lock()
+    defer sc.epLock.Unlock()
+    old := sc.loadEndpoints()
+    for i, ep := range old {
         if ep.key == node.Path {
             //关心的数据确实发生变化
             if !ep.equalTo(node) {
                 log.Printf("[prpc] update endpoint<%+v> by node<%+v>", ep, node)
-                ep.update(node)
+                eps := make([]*endPoint, len(old))
+                copy(eps, old)
+                eps[i] = ep.update(node)
+                sc.endPoints.Store(eps)
             }
             return
         }
@@ -281,6 +607,22 @@ func (sc *SvcClient) updateEndpoint(node *registry.Node) {
     log.Printf("[prpc][ERROR] node<%+v> update, found no corresponding endpoint", node)
 }
 
+//停止后台任务，关闭所有节点的连接
+func (sc *SvcClient) close() {
+    sc.once.Do(func() {
+        close(sc.exit)
+    })
+    sc.wg.Wait()
+
+    sc.epLock.Lock()
+    defer sc.epLock.Unlock()
+    eps := sc.loadEndpoints()
+    sc.endPoints.Store([]*endPoint{})
+    for _, ep := range eps {
+        ep.retire()
+    }
+}
+
 func (sc *SvcClient) hashCode() (string, error) {
     var err error
     endian := binary.LittleEndian
@@ -292,8 +634,35 @@ func (sc *SvcClient) hashCode() (string, error) {
             return "", err
         }
     }
-    for _, v := range []string{sc.service, sc.group, sc.version} {
-        buf.Write([]byte(v))
+    vrule, rrule := "", ""
+    if sc.versionRule != nil {
+        vrule = sc.versionRule.text
+    }
+    if sc.routeRule != nil {
+        rrule = sc.routeRule.text
+    }
+    tlsID, credsID := "", ""
+    if sc.tlsConfig != nil {
+        tlsID = fmt.Sprintf("%p", sc.tlsConfig)
+    }
+    if sc.creds != nil {
+        credsID = fmt.Sprintf("%p", sc.creds)
+    }
+    compressID := fmt.Sprintf("%d/%d", sc.compress, sc.compressThreshold)
+    breakerID := fmt.Sprintf("%+v", sc.breakerConfig)
+    outlierID := ""
+    if sc.outlierConfig != nil {
+        outlierID = fmt.Sprintf("%+v/%p", *sc.outlierConfig, sc.outlierHook)
+    }
+    healthID := fmt.Sprintf("%v/%v", sc.healthInterval, sc.healthTimeout)
+    //每个字段带长度前缀，不同的字段组合拼接后不会相同
+    for _, v := range []string{sc.service, sc.group, sc.version, vrule, rrule, sc.customID, tlsID, credsID, compressID, breakerID, outlierID, healthID} {
+        err = binary.Write(buf, endian, int32(len(v)))
+        if err != nil {
+            log.Println("[prpc][ERROR] binary.Write failed:", err)
+            return "", err
+        }
+        buf.WriteString(v)
     }
     hash := sha256.New()
     hash.Write(buf.Bytes())
@@ -309,10 +678,11 @@ func (sc *SvcClient) dumpMetrics() {
     log.Printf("reqTimes<%v> succTimes<%v>", sc.reqTimes, sc.succTimes)
     sc.statLock.Unlock()
 
-    for _, ep := range sc.endPoints {
-        ep.lock.Lock()
-        log.Printf("endpoint: index<%v> weight<%v> callTimes<%v>", ep.index, ep.weight, ep.callTimes)
-        ep.lock.Unlock()
+    for _, ep := range sc.loadEndpoints() {
+        ep.stats.lock.Lock()
+        log.Printf("endpoint: index<%v> weight<%v> callTimes<%v> ewma<%v> breaker<%v>",
+            ep.index, ep.weight, ep.stats.callTimes, time.Duration(ep.stats.ewma), ep.breaker.currentState())
+        ep.stats.lock.Unlock()
     }
 }
 
@@ -326,7 +696,9 @@ func newSvcClient(service, group string, reg *registry.Registry, opts ...fnOptio
         version:    registry.DefaultVersion,  //默认匹配缺省版本
         index:      noSpecifiedIndex,         //默认不指定index
         selectType: SelectTypeWeightedRandom, //默认按照权重随机获得endpoint
-        breakers:   make(map[string]bool),
+        breakerConfig: DefaultBreakerConfig,
+        compress:      compress.Gzip,
+        exit:          make(chan struct{}),
     }
     //修饰svcClient
     err := sc.decorate(opts...)
@@ -335,6 +707,10 @@ func newSvcClient(service, group string, reg *registry.Registry, opts ...fnOptio
         return nil
     }
     //设置selector
+    if sc.custom != nil {
+        sc.selector = adaptSelector(sc.custom, sc.service, sc.group)
+        return sc
+    }
     cs := configSelect{
         typ:   sc.selectType,
         index: sc.index,
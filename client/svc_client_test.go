@@ -0,0 +1,164 @@
+package client
+
+import (
+    "fmt"
+    "net"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/philipyao/prpc/registry"
+)
+
+func makePipeConn() *RPCClient {
+    c1, c2 := net.Pipe()
+    c2.Close()
+    return &RPCClient{
+        conn:     c1,
+        pending:  make(map[uint16]*Call),
+        shutdown: make(chan struct{}),
+    }
+}
+
+func isClosed(rc *RPCClient) bool {
+    rc.mutex.Lock()
+    defer rc.mutex.Unlock()
+    return rc.closing
+}
+
+//最后一个调用结束后异步关闭连接
+func waitClosed(rc *RPCClient) bool {
+    for i := 0; i < 100; i++ {
+        if isClosed(rc) {
+            return true
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    return false
+}
+
+func TestEndpointsCopyOnWrite(t *testing.T) {
+    sc := newSvcClient("Arith", "zone1001", nil, WithVersionAll(), WithSelectType(SelectTypeRoundRobin))
+    eps := makeEndpoints(10, 10, 10, 10)
+    for _, ep := range eps {
+        ep.breaker = newCircuitBreaker(&sc.breakerConfig)
+        ep.conn = makePipeConn()
+    }
+    sc.endPoints.Store(eps)
+
+    //删除节点时有进行中的调用，调用结束后才关闭连接
+    busy, err := sc.pick(&callInfo{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    sc.delEndpoint([]string{busy.key})
+    if isClosed(busy.conn) {
+        t.Fatal("endpoint conn closed with inflight call")
+    }
+    if busy.acquire() {
+        t.Fatal("removed endpoint acquired")
+    }
+    busy.release()
+
+    var wg sync.WaitGroup
+    stop := make(chan struct{})
+    for g := 0; g < 4; g++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for {
+                select {
+                case <-stop:
+                    return
+                default:
+                }
+                ep, err := sc.pick(&callInfo{})
+                if err != nil {
+                    t.Error(err)
+                    return
+                }
+                if ep.weight <= 0 {
+                    t.Errorf("invalid endpoint selected: %+v", ep)
+                }
+                ep.release()
+            }
+        }()
+    }
+    //并发地更新、删除节点
+    for i := 0; i < 100; i++ {
+        for _, ep := range sc.loadEndpoints() {
+            sc.updateEndpoint(&registry.Node{
+                Path:       ep.key,
+                NodeOption: &registry.NodeOption{Weight: i%10 + 1, Version: fmt.Sprintf("v1.%v", i)},
+            })
+        }
+    }
+    sc.delEndpoint([]string{eps[1].key})
+    close(stop)
+    wg.Wait()
+
+    if n := len(sc.loadEndpoints()); n != 2 {
+        t.Fatalf("%v endpoints left, expect 2", n)
+    }
+    for _, ep := range eps[:2] {
+        if !waitClosed(ep.conn) {
+            t.Fatalf("removed endpoint %v conn not closed", ep.index)
+        }
+    }
+    for _, ep := range sc.loadEndpoints() {
+        if ep.weight != 10 || ep.version != "v1.99" {
+            t.Fatalf("endpoint not updated: %+v", ep)
+        }
+        if isClosed(ep.conn) {
+            t.Fatalf("endpoint %v conn closed", ep.index)
+        }
+    }
+}
+
+func TestUnhealthyEndpointFiltered(t *testing.T) {
+    sc := newSvcClient("Arith", "zone1001", nil, WithVersionAll(), WithHealthCheck(time.Second, time.Second))
+    eps := makeEndpoints(10, 10)
+    for _, ep := range eps {
+        ep.breaker = newCircuitBreaker(&sc.breakerConfig)
+    }
+    sc.endPoints.Store(eps)
+
+    eps[0].stats.unhealthy = true
+    for i := 0; i < 20; i++ {
+        ep, err := sc.selectEndpoint(sc.loadEndpoints(), &callInfo{})
+        if err != nil {
+            t.Fatal(err)
+        }
+        if ep == eps[0] {
+            t.Fatal("unhealthy endpoint selected")
+        }
+    }
+    eps[1].stats.unhealthy = true
+    if _, err := sc.selectEndpoint(sc.loadEndpoints(), &callInfo{}); err == nil {
+        t.Fatal("endpoint selected while all unhealthy")
+    }
+}
+
+func TestDisabledEndpoint(t *testing.T) {
+    sc := newSvcClient("Arith", "zone1001", nil, WithVersionAll())
+    eps := makeEndpoints(10, 10)
+    for _, ep := range eps {
+        ep.breaker = newCircuitBreaker(&sc.breakerConfig)
+    }
+    sc.endPoints.Store(eps)
+
+    //服务方在线禁用节点
+    sc.updateEndpoint(&registry.Node{
+        Path:       eps[0].key,
+        NodeOption: &registry.NodeOption{Weight: 10, Version: "v1.0", Disabled: true},
+    })
+    for i := 0; i < 20; i++ {
+        ep, err := sc.selectEndpoint(sc.loadEndpoints(), &callInfo{})
+        if err != nil {
+            t.Fatal(err)
+        }
+        if ep.key == eps[0].key {
+            t.Fatal("disabled endpoint selected")
+        }
+    }
+}
@@ -0,0 +1,167 @@
+package client
+
+import (
+    "context"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "math/big"
+    "net"
+    "testing"
+    "time"
+
+    "github.com/philipyao/prpc/codec"
+    "github.com/philipyao/prpc/registry"
+    "github.com/philipyao/prpc/server"
+)
+
+type testCA struct {
+    cert *x509.Certificate
+    key  *ecdsa.PrivateKey
+    pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+    ca := &testCA{pool: x509.NewCertPool()}
+    ca.cert, ca.key = ca.issue(t, &x509.Certificate{
+        Subject:               pkix.Name{CommonName: "prpc test ca"},
+        IsCA:                  true,
+        KeyUsage:              x509.KeyUsageCertSign,
+        BasicConstraintsValid: true,
+    })
+    ca.pool.AddCert(ca.cert)
+    return ca
+}
+
+//签发证书，ca.cert为nil时自签名
+func (ca *testCA) issue(t *testing.T, tmpl *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+    tmpl.NotBefore = time.Now().Add(-time.Hour)
+    tmpl.NotAfter = time.Now().Add(time.Hour)
+    parent, signer := tmpl, key
+    if ca.cert != nil {
+        parent, signer = ca.cert, ca.key
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cert, err := x509.ParseCertificate(der)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return cert, key
+}
+
+func (ca *testCA) keyPair(t *testing.T, tmpl *x509.Certificate) tls.Certificate {
+    cert, key := ca.issue(t, tmpl)
+    return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}
+}
+
+type Identity int
+
+//返回调用方证书标识的身份
+func (i *Identity) Whoami(ctx context.Context, args int, reply *string) error {
+    peer, ok := server.PeerFromContext(ctx)
+    if !ok {
+        *reply = "unknown"
+        return nil
+    }
+    *reply = peer.Identity()
+    return nil
+}
+
+func TestMutualTLS(t *testing.T) {
+    ca := newTestCA(t)
+    srvCert := ca.keyPair(t, &x509.Certificate{
+        Subject:     pkix.Name{CommonName: "arith server"},
+        IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+        ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+    })
+    cliCert := ca.keyPair(t, &x509.Certificate{
+        Subject:     pkix.Name{CommonName: "client1"},
+        ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+    })
+
+    srv := server.New("zone1001", 1, server.WithTLSConfig(&tls.Config{
+        Certificates: []tls.Certificate{srvCert},
+        ClientAuth:   tls.RequireAndVerifyClientCert,
+        ClientCAs:    ca.pool,
+    }))
+    if srv == nil {
+        t.Fatal("new tls server failed")
+    }
+    if err := srv.Handle(new(Identity), "Identity"); err != nil {
+        t.Fatal(err)
+    }
+    if err := srv.Serve("127.0.0.1:0", nil); err != nil {
+        t.Fatal(err)
+    }
+    defer srv.Fini()
+    addr := srv.Addr().String()
+
+    //节点标记为TLS，自动使用TLS连接
+    sc := newSvcClient("Identity", "zone1001", nil, WithTLSConfig(&tls.Config{
+        Certificates: []tls.Certificate{cliCert},
+        RootCAs:      ca.pool,
+    }))
+    defer sc.close()
+    sc.addEndpoint([]*registry.Node{{
+        Path: "/Identity/zone1001.1",
+        ID:   registry.ID{Group: "zone1001", Index: 1},
+        Addr: addr,
+        NodeOption: &registry.NodeOption{
+            Weight:  10,
+            Styp:    int(codec.SerializeTypeMsgpack),
+            Version: registry.DefaultVersion,
+            TLS:     true,
+        },
+    }})
+    if len(sc.loadEndpoints()) != 1 {
+        t.Fatal("tls endpoint not connected")
+    }
+    var reply string
+    if err := sc.Call("Whoami", 1, &reply); err != nil {
+        t.Fatal(err)
+    }
+    if reply != "client1" {
+        t.Fatalf("unexpected peer identity %q", reply)
+    }
+
+    //不提供客户端证书
+    cli, err := Dial(addr, WithDialTLS(&tls.Config{RootCAs: ca.pool}), WithDialTimeout(time.Second))
+    if err == nil {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+        err = cli.Call(ctx, "Identity.Whoami", 1, &reply)
+        cancel()
+        cli.Close()
+    }
+    if err == nil {
+        t.Fatal("call succeeded without client certificate")
+    }
+
+    //服务端证书不受信任
+    _, err = Dial(addr, WithDialTLS(&tls.Config{Certificates: []tls.Certificate{cliCert}}))
+    if err == nil {
+        t.Fatal("untrusted server certificate accepted")
+    }
+
+    //明文连接
+    cli, err = Dial(addr, WithDialTimeout(time.Second))
+    if err == nil {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+        err = cli.Call(ctx, "Identity.Whoami", 1, &reply)
+        cancel()
+        cli.Close()
+    }
+    if err == nil {
+        t.Fatal("plaintext call succeeded on tls server")
+    }
+}
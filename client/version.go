@@ -0,0 +1,261 @@
+package client
+
+import (
+    "fmt"
+    "math/rand"
+    "strconv"
+    "strings"
+
+    "github.com/philipyao/prpc/registry"
+)
+
+//版本约束，如 v1.1、>=v1.1、>=v1.0 <v2.0(空格分隔表示同时满足)
+type versionConstraint struct {
+    op      string
+    version string
+    parts   []int
+}
+
+func (vc *versionConstraint) match(version string) bool {
+    if vc.op == "" {
+        return version == vc.version
+    }
+    parts, err := parseVersion(version)
+    if err != nil {
+        return false
+    }
+    c := compareVersion(parts, vc.parts)
+    switch vc.op {
+    case ">=":
+        return c >= 0
+    case ">":
+        return c > 0
+    case "<=":
+        return c <= 0
+    case "<":
+        return c < 0
+    case "=":
+        return c == 0
+    case "!=":
+        return c != 0
+    }
+    return false
+}
+
+type versionRoute struct {
+    constraints []*versionConstraint
+    percent     int
+}
+
+func (vr *versionRoute) String() string {
+    var cs []string
+    for _, c := range vr.constraints {
+        cs = append(cs, c.op+c.version)
+    }
+    return strings.Join(cs, " ")
+}
+
+func (vr *versionRoute) match(version string) bool {
+    for _, c := range vr.constraints {
+        if !c.match(version) {
+            return false
+        }
+    }
+    return true
+}
+
+//按版本分流的规则，如 "v1.1:10%, v1.0:90%"、">=v1.1"
+type versionRule struct {
+    text   string
+    routes []*versionRoute
+}
+
+func parseVersionRule(text string) (*versionRule, error) {
+    rule := &versionRule{text: text}
+    total := 0
+    for _, item := range strings.Split(text, ",") {
+        item = strings.TrimSpace(item)
+        if item == "" {
+            return nil, fmt.Errorf("empty route in version rule %q", text)
+        }
+        route := &versionRoute{percent: 100}
+        if i := strings.LastIndex(item, ":"); i >= 0 {
+            pct := strings.TrimSpace(item[i+1:])
+            if !strings.HasSuffix(pct, "%") {
+                return nil, fmt.Errorf("invalid percent %q in version rule %q", pct, text)
+            }
+            n, err := strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(pct, "%")))
+            if err != nil || n < 0 || n > 100 {
+                return nil, fmt.Errorf("invalid percent %q in version rule %q", pct, text)
+            }
+            route.percent = n
+            item = strings.TrimSpace(item[:i])
+        }
+        for _, field := range strings.Fields(item) {
+            c, err := parseVersionConstraint(field)
+            if err != nil {
+                return nil, fmt.Errorf("%v in version rule %q", err, text)
+            }
+            route.constraints = append(route.constraints, c)
+        }
+        if len(route.constraints) == 0 {
+            return nil, fmt.Errorf("no version specified in version rule %q", text)
+        }
+        total += route.percent
+        rule.routes = append(rule.routes, route)
+    }
+    if total != 100 {
+        return nil, fmt.Errorf("percents sum to %v in version rule %q, expect 100", total, text)
+    }
+    return rule, nil
+}
+
+func parseVersionConstraint(s string) (*versionConstraint, error) {
+    vc := new(versionConstraint)
+    for _, op := range []string{">=", "<=", "!=", ">", "<", "="} {
+        if strings.HasPrefix(s, op) {
+            vc.op = op
+            s = s[len(op):]
+            break
+        }
+    }
+    if s == "" {
+        return nil, fmt.Errorf("empty version")
+    }
+    vc.version = s
+    if vc.op != "" {
+        parts, err := parseVersion(s)
+        if err != nil {
+            return nil, err
+        }
+        vc.parts = parts
+    }
+    return vc, nil
+}
+
+//解析 v1.2.3 形式的版本号
+func parseVersion(version string) ([]int, error) {
+    s := strings.TrimPrefix(strings.TrimPrefix(version, "v"), "V")
+    //忽略预发布、构建信息
+    if i := strings.IndexAny(s, "-+"); i >= 0 {
+        s = s[:i]
+    }
+    var parts []int
+    for _, p := range strings.Split(s, ".") {
+        n, err := strconv.Atoi(p)
+        if err != nil || n < 0 {
+            return nil, fmt.Errorf("invalid version %q", version)
+        }
+        parts = append(parts, n)
+    }
+    return parts, nil
+}
+
+func compareVersion(a, b []int) int {
+    for i := 0; i < len(a) || i < len(b); i++ {
+        var x, y int
+        if i < len(a) {
+            x = a[i]
+        }
+        if i < len(b) {
+            y = b[i]
+        }
+        if x != y {
+            if x < y {
+                return -1
+            }
+            return 1
+        }
+    }
+    return 0
+}
+
+//按百分比选取路由，有hash key时同一个key总是落在同一个版本
+func (rule *versionRule) route(call *callInfo) *versionRoute {
+    var n int
+    if call != nil && call.hashKey != "" {
+        n = int(hashString(call.hashKey) % 100)
+    } else {
+        n = rand.Intn(100)
+    }
+    for _, route := range rule.routes {
+        if n < route.percent {
+            return route
+        }
+        n -= route.percent
+    }
+    return rule.routes[len(rule.routes)-1]
+}
+
+//按版本过滤节点：
+//指定了版本规则时按规则分流，所选版本没有节点则回退到缺省版本，调用方传入可用的节点；
+//否则匹配指定的版本，未指定版本时返回全部节点
+func (sc *SvcClient) matchVersion(endPoints []*endPoint, call *callInfo) []*endPoint {
+    return sc.matchRoute(endPoints, sc.versionRoute(call))
+}
+
+//按版本规则选取本次调用的路由，没有版本规则时返回nil
+func (sc *SvcClient) versionRoute(call *callInfo) *versionRoute {
+    if sc.versionRule == nil {
+        return nil
+    }
+    return sc.versionRule.route(call)
+}
+
+//按已选取的路由过滤节点，route为nil时匹配指定的版本
+func (sc *SvcClient) matchRoute(endPoints []*endPoint, route *versionRoute) []*endPoint {
+    if route == nil {
+        if sc.version == noSpecifiedVersion {
+            return endPoints
+        }
+        return filterEndpoints(endPoints, func(ep *endPoint) bool {
+            return ep.version == sc.version
+        })
+    }
+    eps := filterEndpoints(endPoints, func(ep *endPoint) bool {
+        return route.match(ep.version)
+    })
+    if len(eps) > 0 {
+        return eps
+    }
+    return filterEndpoints(endPoints, func(ep *endPoint) bool {
+        return ep.version == registry.DefaultVersion
+    })
+}
+
+//广播时的版本过滤：版本规则中各个路由选中的节点的并集，
+//某个路由没有节点时与单次调用一样回退到缺省版本
+func (sc *SvcClient) matchVersions(endPoints []*endPoint) []*endPoint {
+    if sc.versionRule == nil {
+        return sc.matchVersion(endPoints, nil)
+    }
+    fallback := false
+    matched := make(map[*endPoint]bool)
+    for _, route := range sc.versionRule.routes {
+        if route.percent == 0 {
+            continue
+        }
+        eps := filterEndpoints(endPoints, func(ep *endPoint) bool {
+            return route.match(ep.version)
+        })
+        if len(eps) == 0 {
+            fallback = true
+        }
+        for _, ep := range eps {
+            matched[ep] = true
+        }
+    }
+    return filterEndpoints(endPoints, func(ep *endPoint) bool {
+        return matched[ep] || (fallback && ep.version == registry.DefaultVersion)
+    })
+}
+
+func filterEndpoints(endPoints []*endPoint, fn func(ep *endPoint) bool) []*endPoint {
+    var eps []*endPoint
+    for _, ep := range endPoints {
+        if fn(ep) {
+            eps = append(eps, ep)
+        }
+    }
+    return eps
+}
@@ -0,0 +1,142 @@
+package client
+
+import (
+    "fmt"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestParseVersionRule(t *testing.T) {
+    for _, text := range []string{"v1.1:10%, v1.0:90%", ">=v1.1", ">=v1.0 <v2.0:50%,v2.0:50%", "v1.0"} {
+        if _, err := parseVersionRule(text); err != nil {
+            t.Fatalf("parse %q: %v", text, err)
+        }
+    }
+    for _, text := range []string{"", "v1.1:10%", "v1.1:10, v1.0:90", ">=:100%", ">=vx.1", "v1.1:-10%,v1.0:110%"} {
+        if _, err := parseVersionRule(text); err == nil {
+            t.Fatalf("invalid rule %q parsed", text)
+        }
+    }
+}
+
+func TestVersionConstraint(t *testing.T) {
+    rule, err := parseVersionRule(">=v1.1 <v2")
+    if err != nil {
+        t.Fatal(err)
+    }
+    route := rule.routes[0]
+    for version, expect := range map[string]bool{
+        "v1.0":     false,
+        "v1.1":     true,
+        "v1.1.5":   true,
+        "v1.10":    true,
+        "v2.0":     false,
+        "v1.2-rc1": true,
+        "unknown":  false,
+    } {
+        if route.match(version) != expect {
+            t.Fatalf("version %v match %v, expect %v", version, !expect, expect)
+        }
+    }
+}
+
+func TestVersionRouting(t *testing.T) {
+    sc := newSvcClient("Arith", "zone1001", nil, WithVersionRule("v1.1:10%, v1.0:90%"))
+    if sc == nil {
+        t.Fatal("new service client failed")
+    }
+    eps := makeEndpoints(10, 10, 10)
+    eps[0].version, eps[1].version, eps[2].version = "v1.0", "v1.0", "v1.1"
+
+    counts := make(map[string]int)
+    for i := 0; i < 10000; i++ {
+        for _, ep := range sc.matchVersion(eps, &callInfo{}) {
+            counts[ep.version]++
+            break
+        }
+    }
+    if counts["v1.1"] < 800 || counts["v1.1"] > 1200 {
+        t.Fatalf("unexpected traffic split: %v", counts)
+    }
+
+    //相同hash key总是落在同一版本
+    for i := 0; i < 100; i++ {
+        call := &callInfo{hashKey: fmt.Sprintf("player%v", i)}
+        version := sc.matchVersion(eps, call)[0].version
+        for j := 0; j < 10; j++ {
+            if sc.matchVersion(eps, call)[0].version != version {
+                t.Fatalf("hash key %v routed to different versions", call.hashKey)
+            }
+        }
+    }
+
+    //v1.1没有节点时回退到缺省版本
+    for i := 0; i < 100; i++ {
+        for _, ep := range sc.matchVersion(eps[:2], &callInfo{}) {
+            if ep.version != "v1.0" {
+                t.Fatalf("unexpected version %v", ep.version)
+            }
+        }
+        if len(sc.matchVersion(eps[:2], &callInfo{})) != 2 {
+            t.Fatal("no fallback to default version")
+        }
+    }
+}
+
+//灰度节点禁用或不健康时，其流量回退到缺省版本
+func TestVersionFallbackUnavailable(t *testing.T) {
+    sc := newSvcClient("Arith", "zone1001", nil, WithVersionRule("v1.1:50%, v1.0:50%"))
+    eps := makeEndpoints(10, 10, 10)
+    eps[0].version, eps[1].version, eps[2].version = "v1.0", "v1.0", "v1.1"
+    for _, ep := range eps {
+        ep.breaker = newCircuitBreaker(&sc.breakerConfig)
+    }
+    canary := eps[2]
+    for _, unavailable := range []func(){
+        func() { canary.disabled = true },
+        func() { canary.disabled, canary.stats.unhealthy = false, true },
+    } {
+        unavailable()
+        for i := 0; i < 100; i++ {
+            ep, err := sc.selectEndpoint(eps, &callInfo{})
+            if err != nil {
+                t.Fatal(err)
+            }
+            if ep == canary {
+                t.Fatal("unavailable canary selected")
+            }
+        }
+    }
+
+    //缺省版本也不可用时返回具体原因
+    canary.stats.unhealthy = false
+    for _, ep := range eps[:2] {
+        ep.disabled = true
+    }
+    canary.breaker.reset(breakerOpen, time.Now())
+    if _, err := sc.selectEndpoint(eps, &callInfo{hashKey: "player1"}); err == nil {
+        t.Fatal("endpoint selected while all unavailable")
+    }
+    var tripped bool
+    for i := 0; i < 100 && !tripped; i++ {
+        _, err := sc.selectEndpoint(eps, &callInfo{})
+        tripped = err == ErrBreakerOpen
+    }
+    if !tripped {
+        t.Fatal("breaker open not reported")
+    }
+
+    //返回的原因与本次选取的版本一致
+    for i := 0; i < 100; i++ {
+        call := &callInfo{hashKey: fmt.Sprintf("player%v", i)}
+        canaryRoute := sc.versionRule.route(call).match("v1.1")
+        _, err := sc.selectEndpoint(eps, call)
+        if (err == ErrBreakerOpen) != canaryRoute {
+            t.Fatalf("%v routed to canary %v, err %v", call.hashKey, canaryRoute, err)
+        }
+        if !canaryRoute && (err == nil || !strings.Contains(err.Error(), "v1.0")) {
+            t.Fatalf("%v: unexpected err %v", call.hashKey, err)
+        }
+    }
+}
@@ -3,6 +3,13 @@ package codec
 import (
     "bytes"
     "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "reflect"
+    "sync"
+
+    "github.com/golang/protobuf/proto"
     "github.com/vmihailenco/msgpack"
 )
 
@@ -12,20 +19,41 @@ const (
     SerializeTypeNone SerializeType = iota
     SerializeTypeMsgpack
     SerializeTypeJson
+    SerializeTypeProtobuf
 )
 
 var (
+    lock        sync.RWMutex //protect serializers, names
     serializers = map[SerializeType]Serializer{
-        SerializeTypeMsgpack: &msgpackSerializer{},
-        SerializeTypeJson:    &jsonSerializer{},
+        SerializeTypeMsgpack:  &msgpackSerializer{},
+        SerializeTypeJson:     &jsonSerializer{},
+        SerializeTypeProtobuf: &protobufSerializer{},
+    }
+    names = map[SerializeType]string{
+        SerializeTypeMsgpack:  "msgpack",
+        SerializeTypeJson:     "json",
+        SerializeTypeProtobuf: "protobuf",
     }
+
+    typeOfProtoMessage = reflect.TypeOf((*proto.Message)(nil)).Elem()
 )
 
 type Serializer interface {
     Encode(v interface{}) ([]byte, error)
+    //data所在的缓冲会被复用，Decode返回后不能再引用data
     Decode(data []byte, v interface{}) error
 }
 
+//可选接口，Server.Handle时检查参数类型能否被序列化，尽早发现错误
+type TypeChecker interface {
+    CheckType(t reflect.Type) error
+}
+
+//可选接口，直接序列化到w中，打包时省去一次拷贝
+type StreamEncoder interface {
+    EncodeTo(w io.Writer, v interface{}) error
+}
+
 type jsonSerializer struct{}
 
 func (js jsonSerializer) Encode(v interface{}) ([]byte, error) {
@@ -34,21 +62,33 @@ func (js jsonSerializer) Encode(v interface{}) ([]byte, error) {
 func (js jsonSerializer) Decode(data []byte, v interface{}) error {
     return json.Unmarshal(data, v)
 }
+func (js jsonSerializer) EncodeTo(w io.Writer, v interface{}) error {
+    return json.NewEncoder(w).Encode(v)
+}
 
 type msgpackSerializer struct{}
 
 func (ms msgpackSerializer) Encode(v interface{}) ([]byte, error) {
     var buf bytes.Buffer
-    enc := msgpack.NewEncoder(&buf)
-    //UseJSONTag causes the Decoder to use json struct tag as fallback option if there is no msgpack tag.
-    enc.UseJSONTag(true)
-    err := enc.Encode(v)
+    err := ms.EncodeTo(&buf, v)
     if err != nil {
         return nil, err
     }
     return buf.Bytes(), nil
 }
-func (ms msgpackSerializer) Decode(data []byte, v interface{}) error {
+func (ms msgpackSerializer) EncodeTo(w io.Writer, v interface{}) error {
+    enc := msgpack.NewEncoder(w)
+    //UseJSONTag causes the Decoder to use json struct tag as fallback option if there is no msgpack tag.
+    enc.UseJSONTag(true)
+    return enc.Encode(v)
+}
+func (ms msgpackSerializer) Decode(data []byte, v interface{}) (err error) {
+    //畸形数据可能使msgpack panic，如以map作为map的key
+    defer func() {
+        if r := recover(); r != nil {
+            err = fmt.Errorf("msgpack: decode panic: %v", r)
+        }
+    }()
     buf := bytes.NewBuffer(data)
     dec := msgpack.NewDecoder(buf)
     //UseJSONTag causes the Decoder to use json struct tag as fallback option if there is no msgpack tag.
@@ -56,6 +96,84 @@ func (ms msgpackSerializer) Decode(data []byte, v interface{}) error {
     return dec.Decode(v)
 }
 
+//只支持proto.Message类型的参数
+type protobufSerializer struct{}
+
+func (ps protobufSerializer) Encode(v interface{}) ([]byte, error) {
+    m, ok := v.(proto.Message)
+    if !ok {
+        return nil, fmt.Errorf("protobuf: %T is not proto.Message", v)
+    }
+    return proto.Marshal(m)
+}
+func (ps protobufSerializer) Decode(data []byte, v interface{}) error {
+    m, ok := v.(proto.Message)
+    if !ok {
+        return fmt.Errorf("protobuf: %T is not proto.Message", v)
+    }
+    return proto.Unmarshal(data, m)
+}
+func (ps protobufSerializer) CheckType(t reflect.Type) error {
+    //非指针类型的参数会以指针的形式解码
+    if t.Kind() != reflect.Ptr {
+        t = reflect.PtrTo(t)
+    }
+    if !t.Implements(typeOfProtoMessage) {
+        return fmt.Errorf("protobuf: %v is not proto.Message", t)
+    }
+    return nil
+}
+
+//注册自定义序列化方式，如gob、cbor；styp和name都不能与已有的重复，
+//服务端和客户端需要在使用前以相同的styp注册
+func Register(styp SerializeType, name string, s Serializer) error {
+    if styp == SerializeTypeNone {
+        return errors.New("codec: serialize type none is reserved")
+    }
+    if name == "" {
+        return errors.New("codec: empty serializer name")
+    }
+    if s == nil {
+        return errors.New("codec: nil serializer")
+    }
+    lock.Lock()
+    defer lock.Unlock()
+    if exist, ok := names[styp]; ok {
+        return fmt.Errorf("codec: serialize type %v already registered as %v", int(styp), exist)
+    }
+    for t, n := range names {
+        if n == name {
+            return fmt.Errorf("codec: serializer name %v already registered with type %v", name, int(t))
+        }
+    }
+    serializers[styp] = s
+    names[styp] = name
+    return nil
+}
+
 func GetSerializer(styp SerializeType) Serializer {
+    lock.RLock()
+    defer lock.RUnlock()
     return serializers[styp]
 }
+
+//按名字查找序列化方式，用于配置文件
+func Lookup(name string) (SerializeType, bool) {
+    lock.RLock()
+    defer lock.RUnlock()
+    for styp, n := range names {
+        if n == name {
+            return styp, true
+        }
+    }
+    return SerializeTypeNone, false
+}
+
+func (styp SerializeType) String() string {
+    lock.RLock()
+    defer lock.RUnlock()
+    if name, ok := names[styp]; ok {
+        return name
+    }
+    return fmt.Sprintf("SerializeType(%d)", int(styp))
+}
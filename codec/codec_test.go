@@ -0,0 +1,131 @@
+package codec
+
+import (
+    "bytes"
+    "encoding/gob"
+    "reflect"
+    "testing"
+
+    "github.com/golang/protobuf/proto"
+    "github.com/golang/protobuf/ptypes/wrappers"
+)
+
+func TestProtobuf(t *testing.T) {
+    s := GetSerializer(SerializeTypeProtobuf)
+    if s == nil {
+        t.Fatal("protobuf serializer not found")
+    }
+    data, err := s.Encode(&wrappers.StringValue{Value: "hello"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    var v wrappers.StringValue
+    if err := s.Decode(data, &v); err != nil {
+        t.Fatal(err)
+    }
+    if v.Value != "hello" {
+        t.Fatalf("unexpected value %q", v.Value)
+    }
+
+    if _, err := s.Encode(&struct{ A int }{1}); err == nil {
+        t.Fatal("non proto value encoded")
+    }
+    var n int
+    if err := s.Decode(data, &n); err == nil {
+        t.Fatal("decoded into non proto value")
+    }
+}
+
+func TestCheckType(t *testing.T) {
+    checker, ok := GetSerializer(SerializeTypeProtobuf).(TypeChecker)
+    if !ok {
+        t.Fatal("protobuf serializer should check types")
+    }
+    for _, typ := range []reflect.Type{
+        reflect.TypeOf(&wrappers.Int64Value{}),
+        reflect.TypeOf(wrappers.Int64Value{}),
+    } {
+        if err := checker.CheckType(typ); err != nil {
+            t.Fatalf("type %v: %v", typ, err)
+        }
+    }
+    //接口类型无法创建实例解码
+    for _, typ := range []reflect.Type{
+        reflect.TypeOf(0),
+        reflect.TypeOf(new(string)),
+        reflect.TypeOf((*proto.Message)(nil)).Elem(),
+    } {
+        if err := checker.CheckType(typ); err == nil {
+            t.Fatalf("type %v accepted", typ)
+        }
+    }
+    if _, ok := GetSerializer(SerializeTypeMsgpack).(TypeChecker); ok {
+        t.Fatal("msgpack serializer should accept any type")
+    }
+}
+
+const serializeTypeGob SerializeType = 100
+
+type gobSerializer struct{}
+
+func (gs gobSerializer) Encode(v interface{}) ([]byte, error) {
+    var buf bytes.Buffer
+    err := gob.NewEncoder(&buf).Encode(v)
+    return buf.Bytes(), err
+}
+func (gs gobSerializer) Decode(data []byte, v interface{}) error {
+    return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func init() {
+    if err := Register(serializeTypeGob, "gob", gobSerializer{}); err != nil {
+        panic(err)
+    }
+}
+
+func TestRegister(t *testing.T) {
+    if GetSerializer(serializeTypeGob) == nil {
+        t.Fatal("registered serializer not found")
+    }
+    styp, ok := Lookup("gob")
+    if !ok || styp != serializeTypeGob {
+        t.Fatalf("lookup gob: %v %v", styp, ok)
+    }
+    if styp, ok := Lookup("msgpack"); !ok || styp != SerializeTypeMsgpack {
+        t.Fatalf("lookup msgpack: %v %v", styp, ok)
+    }
+    if _, ok := Lookup("cbor"); ok {
+        t.Fatal("unregistered name found")
+    }
+    if serializeTypeGob.String() != "gob" || SerializeType(200).String() != "SerializeType(200)" {
+        t.Fatalf("unexpected names %v %v", serializeTypeGob, SerializeType(200))
+    }
+
+    cases := []struct {
+        styp SerializeType
+        name string
+        s    Serializer
+    }{
+        {serializeTypeGob, "gob2", gobSerializer{}},   //类型重复
+        {SerializeTypeJson, "json2", gobSerializer{}}, //覆盖内置
+        {101, "gob", gobSerializer{}},                 //名字重复
+        {SerializeTypeNone, "none", gobSerializer{}},  //保留
+        {102, "", gobSerializer{}},
+        {103, "nil", nil},
+    }
+    for _, c := range cases {
+        if err := Register(c.styp, c.name, c.s); err == nil {
+            t.Fatalf("register %v %q accepted", int(c.styp), c.name)
+        }
+    }
+
+    s := GetSerializer(serializeTypeGob)
+    data, err := s.Encode(map[string]int{"a": 1})
+    if err != nil {
+        t.Fatal(err)
+    }
+    var m map[string]int
+    if err := s.Decode(data, &m); err != nil || m["a"] != 1 {
+        t.Fatalf("decode gob: %v %v", m, err)
+    }
+}
@@ -0,0 +1,264 @@
+package compress
+
+import (
+    "bytes"
+    "compress/gzip"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "sync"
+
+    "github.com/golang/snappy"
+    "github.com/klauspost/compress/zstd"
+    "github.com/pierrec/lz4"
+)
+
+type Kind byte
+
+const (
+    None Kind = iota
+    Gzip
+    Snappy
+    LZ4
+    Zstd
+
+    MaxKind Kind = 7 //包头中占3位
+)
+
+var (
+    lock        sync.RWMutex //protect compressors, names
+    compressors = map[Kind]Compressor{
+        Gzip:   &gzipCompressor{},
+        Snappy: &snappyCompressor{},
+        LZ4:    &lz4Compressor{},
+        Zstd:   &zstdCompressor{},
+    }
+    names = map[Kind]string{
+        Gzip:   "gzip",
+        Snappy: "snappy",
+        LZ4:    "lz4",
+        Zstd:   "zstd",
+    }
+)
+
+var ErrTooLarge = errors.New("compress: decompressed data too large")
+
+type Compressor interface {
+    Compress(data []byte) ([]byte, error)
+    //解压后超过maxSize字节时返回ErrTooLarge，maxSize<=0不限制；data来自对端，不能信任
+    Decompress(data []byte, maxSize int) ([]byte, error)
+}
+
+//对端使用了本端不支持的压缩方式
+type UnsupportedError struct {
+    Kind Kind
+}
+
+func (e *UnsupportedError) Error() string {
+    return fmt.Sprintf("compress: unsupported kind %v", e.Kind)
+}
+
+type gzipCompressor struct {
+    writers sync.Pool
+}
+
+func (gc *gzipCompressor) Compress(data []byte) ([]byte, error) {
+    var buf bytes.Buffer
+    w, ok := gc.writers.Get().(*gzip.Writer)
+    if ok {
+        w.Reset(&buf)
+    } else {
+        w = gzip.NewWriter(&buf)
+    }
+    defer gc.writers.Put(w)
+    if _, err := w.Write(data); err != nil {
+        return nil, err
+    }
+    if err := w.Close(); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+func (gc *gzipCompressor) Decompress(data []byte, maxSize int) ([]byte, error) {
+    r, err := gzip.NewReader(bytes.NewReader(data))
+    if err != nil {
+        return nil, err
+    }
+    defer r.Close()
+    return readLimit(r, maxSize)
+}
+
+type snappyCompressor struct{}
+
+func (sc *snappyCompressor) Compress(data []byte) ([]byte, error) {
+    return snappy.Encode(nil, data), nil
+}
+func (sc *snappyCompressor) Decompress(data []byte, maxSize int) ([]byte, error) {
+    //解压后的长度写在数据头部，先检查再分配
+    n, err := snappy.DecodedLen(data)
+    if err != nil {
+        return nil, err
+    }
+    if maxSize > 0 && n > maxSize {
+        return nil, ErrTooLarge
+    }
+    return snappy.Decode(nil, data)
+}
+
+type lz4Compressor struct{}
+
+func (lc *lz4Compressor) Compress(data []byte) ([]byte, error) {
+    var buf bytes.Buffer
+    w := lz4.NewWriter(&buf)
+    if _, err := w.Write(data); err != nil {
+        return nil, err
+    }
+    if err := w.Close(); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+func (lc *lz4Compressor) Decompress(data []byte, maxSize int) ([]byte, error) {
+    return readLimit(lz4.NewReader(bytes.NewReader(data)), maxSize)
+}
+
+//解压时按窗口大小分配内存，限制窗口防止伪造的帧头导致大量分配
+const zstdMaxWindow = 8 << 20
+
+//EncodeAll可以并发调用，第一次使用时创建；解压时流式读取以限制长度，decoder放在池中复用
+type zstdCompressor struct {
+    once     sync.Once
+    enc      *zstd.Encoder
+    err      error
+    decoders sync.Pool
+}
+
+func (zc *zstdCompressor) init() error {
+    zc.once.Do(func() {
+        zc.enc, zc.err = zstd.NewWriter(nil)
+    })
+    return zc.err
+}
+func (zc *zstdCompressor) Compress(data []byte) ([]byte, error) {
+    if err := zc.init(); err != nil {
+        return nil, err
+    }
+    return zc.enc.EncodeAll(data, nil), nil
+}
+func (zc *zstdCompressor) Decompress(data []byte, maxSize int) ([]byte, error) {
+    //帧头中带有解压后的长度时先检查
+    var h zstd.Header
+    if err := h.Decode(data); err != nil {
+        return nil, err
+    }
+    if maxSize > 0 && h.HasFCS && h.FrameContentSize > uint64(maxSize) {
+        return nil, ErrTooLarge
+    }
+    dec, ok := zc.decoders.Get().(*zstd.Decoder)
+    if ok {
+        if err := dec.Reset(bytes.NewReader(data)); err != nil {
+            dec.Close()
+            return nil, err
+        }
+    } else {
+        var err error
+        dec, err = zstd.NewReader(bytes.NewReader(data),
+            zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstdMaxWindow))
+        if err != nil {
+            return nil, err
+        }
+    }
+    out, err := readLimit(dec, maxSize)
+    if err != nil {
+        dec.Close()
+        return nil, err
+    }
+    zc.decoders.Put(dec)
+    return out, nil
+}
+
+//最多读取maxSize字节，超出时返回ErrTooLarge
+func readLimit(r io.Reader, maxSize int) ([]byte, error) {
+    if maxSize <= 0 {
+        return ioutil.ReadAll(r)
+    }
+    out, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+    if err != nil {
+        return nil, err
+    }
+    if len(out) > maxSize {
+        return nil, ErrTooLarge
+    }
+    return out, nil
+}
+
+//注册自定义压缩方式，kind和name都不能与已有的重复，
+//服务端和客户端需要在使用前以相同的kind注册
+func Register(kind Kind, name string, c Compressor) error {
+    if kind == None || kind > MaxKind {
+        return fmt.Errorf("compress: invalid kind %d", int(kind))
+    }
+    if name == "" {
+        return errors.New("compress: empty compressor name")
+    }
+    if c == nil {
+        return errors.New("compress: nil compressor")
+    }
+    lock.Lock()
+    defer lock.Unlock()
+    if exist, ok := names[kind]; ok {
+        return fmt.Errorf("compress: kind %d already registered as %v", int(kind), exist)
+    }
+    for k, n := range names {
+        if n == name {
+            return fmt.Errorf("compress: compressor name %v already registered with kind %d", name, int(k))
+        }
+    }
+    compressors[kind] = c
+    names[kind] = name
+    return nil
+}
+
+func Get(kind Kind) Compressor {
+    lock.RLock()
+    defer lock.RUnlock()
+    return compressors[kind]
+}
+
+//按名字查找压缩方式，用于配置文件和节点信息
+func Lookup(name string) (Kind, bool) {
+    lock.RLock()
+    defer lock.RUnlock()
+    for kind, n := range names {
+        if n == name {
+            return kind, true
+        }
+    }
+    return None, false
+}
+
+//本端支持的压缩方式，按kind排序，注册到服务中心供客户端选择
+func Supported() []string {
+    lock.RLock()
+    defer lock.RUnlock()
+    var supported []string
+    for kind := None + 1; kind <= MaxKind; kind++ {
+        if name, ok := names[kind]; ok {
+            supported = append(supported, name)
+        }
+    }
+    return supported
+}
+
+func (k Kind) String() string {
+    if k == None {
+        return "none"
+    }
+    lock.RLock()
+    defer lock.RUnlock()
+    if name, ok := names[k]; ok {
+        return name
+    }
+    return fmt.Sprintf("Kind(%d)", int(k))
+}
@@ -0,0 +1,70 @@
+package compress
+
+import (
+    "bytes"
+    "testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+    data := bytes.Repeat([]byte("prpc compress "), 512)
+    for _, kind := range []Kind{Gzip, Snappy, LZ4, Zstd} {
+        c := Get(kind)
+        if c == nil {
+            t.Fatalf("%v not registered", kind)
+        }
+        compressed, err := c.Compress(data)
+        if err != nil {
+            t.Fatalf("%v compress: %v", kind, err)
+        }
+        if len(compressed) >= len(data) {
+            t.Fatalf("%v not compressed: %v", kind, len(compressed))
+        }
+        out, err := c.Decompress(compressed, len(data))
+        if err != nil {
+            t.Fatalf("%v decompress: %v", kind, err)
+        }
+        if !bytes.Equal(out, data) {
+            t.Fatalf("%v round trip mismatch", kind)
+        }
+        if _, err := c.Decompress([]byte("garbage"), 0); err == nil {
+            t.Fatalf("%v decompress garbage", kind)
+        }
+        //解压后超出限制
+        if _, err := c.Decompress(compressed, len(data)-1); err != ErrTooLarge {
+            t.Fatalf("%v decompress over limit: %v", kind, err)
+        }
+    }
+}
+
+type nopCompressor struct{}
+
+func (nc nopCompressor) Compress(data []byte) ([]byte, error)   { return data, nil }
+func (nc nopCompressor) Decompress(data []byte, maxSize int) ([]byte, error) { return data, nil }
+
+func TestRegister(t *testing.T) {
+    if err := Register(None, "nop", nopCompressor{}); err == nil {
+        t.Fatal("register kind none")
+    }
+    if err := Register(MaxKind+1, "nop", nopCompressor{}); err == nil {
+        t.Fatal("register kind out of range")
+    }
+    if err := Register(Zstd, "nop", nopCompressor{}); err == nil {
+        t.Fatal("register duplicate kind")
+    }
+    if err := Register(6, "gzip", nopCompressor{}); err == nil {
+        t.Fatal("register duplicate name")
+    }
+    if err := Register(6, "nop", nopCompressor{}); err != nil {
+        t.Fatal(err)
+    }
+    if kind, ok := Lookup("nop"); !ok || kind != 6 || Get(6) == nil {
+        t.Fatalf("lookup nop: %v %v", kind, ok)
+    }
+    supported := Supported()
+    if len(supported) != 5 || supported[0] != "gzip" || supported[4] != "nop" {
+        t.Fatalf("unexpected supported %v", supported)
+    }
+    if Kind(7).String() != "Kind(7)" {
+        t.Fatalf("unexpected name %v", Kind(7))
+    }
+}
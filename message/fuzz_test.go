@@ -0,0 +1,263 @@
+package message
+
+import (
+    "bytes"
+    "io"
+    "io/ioutil"
+    "path/filepath"
+    "runtime"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "testing"
+
+    "github.com/golang/protobuf/ptypes/wrappers"
+    "github.com/philipyao/prpc/codec"
+    "github.com/philipyao/prpc/compress"
+)
+
+var (
+    fuzzLimit = Limit{MaxDecompressLen: 1 << 16, MaxMethodLen: 64}
+    //一个包的分配上限：包本身、解压输出和zstd的窗口
+    fuzzMaxAlloc uint64 = 32 << 20
+    //ReadMemStats会stop the world，fuzz时每隔若干次才统计分配
+    fuzzAllocEvery uint64 = 64
+    fuzzExecs      uint64
+)
+
+//统计f执行期间分配的字节数
+func allocBytes(f func()) uint64 {
+    var before, after runtime.MemStats
+    runtime.ReadMemStats(&before)
+    f()
+    runtime.ReadMemStats(&after)
+    return after.TotalAlloc - before.TotalAlloc
+}
+
+//任意输入都不能panic，分配有上限，成功时结果满足限制；
+//testdata/fuzz/FuzzNewResponse下是截断、超长和损坏的包
+func FuzzNewResponse(f *testing.F) {
+    s := codec.GetSerializer(codec.SerializeTypeMsgpack)
+    for _, ck := range []CompressKind{CompressKindNone, CompressKindGzip, CompressKindZstd} {
+        msg := NewRequest(MsgKindDefault, 1)
+        msg.SetSerializeType(codec.SerializeTypeMsgpack)
+        msg.SetCompress(ck, 1)
+        data, err := msg.Pack(serviceMethod, map[string]int{"a": 1}, s)
+        if err != nil {
+            f.Fatal(err)
+        }
+        f.Add(data)
+    }
+    legacy, err := NewRequest(MsgKindDefault, 2).Pack(serviceMethod, "hello", s)
+    if err != nil {
+        f.Fatal(err)
+    }
+    f.Add(legacy)
+    errmsg, err := NewRequest(MsgKindDefault, 3).PackError(serviceMethod, ErrCodeServer, "oops")
+    if err != nil {
+        f.Fatal(err)
+    }
+    f.Add(errmsg)
+
+    f.Fuzz(func(t *testing.T, data []byte) {
+        var rmsg *Message
+        var err error
+        read := func() {
+            rmsg, err = NewResponseLimit(bytes.NewReader(data), fuzzLimit)
+        }
+        if atomic.AddUint64(&fuzzExecs, 1)%fuzzAllocEvery != 0 {
+            read()
+        } else if n := allocBytes(read); n > fuzzMaxAlloc {
+            t.Fatalf("%v bytes allocated for %v bytes frame", n, len(data))
+        }
+        if err != nil {
+            if _, ok := err.(*BodyError); ok && rmsg == nil {
+                t.Fatal("body error without msg")
+            }
+            return
+        }
+        if len(rmsg.data) > fuzzLimit.MaxDecompressLen {
+            t.Fatalf("decompressed %v bytes over limit", len(rmsg.data))
+        }
+        if len(rmsg.ServiceMethod()) > fuzzLimit.MaxMethodLen {
+            t.Fatalf("method %q over limit", rmsg.ServiceMethod())
+        }
+        var v interface{}
+        rmsg.Unpack(s, &v)
+        rmsg.Release()
+    })
+}
+
+//fuzz的序列化方式，SerializeTypeNone按旧版本打包，payload使用msgpack
+func fuzzSerializer(styp codec.SerializeType, payload []byte) (codec.Serializer, interface{}, func() (interface{}, func() []byte)) {
+    if styp == codec.SerializeTypeProtobuf {
+        return codec.GetSerializer(styp), &wrappers.BytesValue{Value: payload}, func() (interface{}, func() []byte) {
+            v := new(wrappers.BytesValue)
+            return v, func() []byte { return v.Value }
+        }
+    }
+    if styp == codec.SerializeTypeNone {
+        styp = codec.SerializeTypeMsgpack
+    }
+    return codec.GetSerializer(styp), payload, func() (interface{}, func() []byte) {
+        v := new([]byte)
+        return v, func() []byte { return *v }
+    }
+}
+
+//打包后读出的结果与原数据一致，覆盖所有序列化方式、压缩方式和新旧版本
+func FuzzRoundTrip(f *testing.F) {
+    styps := []codec.SerializeType{codec.SerializeTypeNone, codec.SerializeTypeMsgpack, codec.SerializeTypeJson, codec.SerializeTypeProtobuf}
+    for _, styp := range styps {
+        for ck := CompressKindNone; ck <= compress.MaxKind; ck++ {
+            f.Add(serviceMethod, []byte("hello"), uint16(1), uint8(styp), uint8(ck), uint16(1))
+        }
+        f.Add(serviceMethod, bytes.Repeat([]byte("prpc"), 1024), uint16(2), uint8(styp), uint8(CompressKindZstd), uint16(0))
+        f.Add(serviceMethod, []byte{}, uint16(3), uint8(styp), uint8(CompressKindNone), uint16(0))
+    }
+    f.Add("", []byte("hello"), uint16(4), uint8(codec.SerializeTypeMsgpack), uint8(CompressKindNone), uint16(0))
+    f.Add(strings.Repeat("a", MaxMethodLen+1), []byte("hello"), uint16(5), uint8(codec.SerializeTypeJson), uint8(CompressKindNone), uint16(0))
+
+    f.Fuzz(func(t *testing.T, method string, payload []byte, seq uint16, st, ck uint8, threshold uint16) {
+        styp := styps[int(st)%len(styps)]
+        kind := CompressKind(ck) % (compress.MaxKind + 1)
+        s, v, newReply := fuzzSerializer(styp, payload)
+
+        msg := NewRequest(MsgKindDefault, seq)
+        msg.SetSerializeType(styp)
+        msg.SetCompress(kind, int(threshold))
+        var w bytes.Buffer
+        err := msg.PackTo(&w, method, v, s)
+        if len(method) > MaxMethodLen && styp != codec.SerializeTypeNone {
+            if err != ErrMethodTooLong {
+                t.Fatalf("long method: %v", err)
+            }
+            return
+        }
+        if _, ok := err.(*compress.UnsupportedError); ok {
+            if compress.Get(kind) != nil {
+                t.Fatalf("registered kind %v unsupported", kind)
+            }
+            return
+        }
+        if err == ErrMsgTooLarge {
+            return
+        }
+        if err != nil {
+            t.Fatalf("pack: %v", err)
+        }
+
+        rmsg, err := NewResponse(&w)
+        if len(method) > DefaultLimit.MaxMethodLen || method == "" {
+            //旧版本不限制打包的method长度，由读包方检查
+            if _, ok := err.(*BodyError); !ok {
+                t.Fatalf("invalid method %q: %v", method, err)
+            }
+            return
+        }
+        if err != nil {
+            t.Fatalf("NewResponse: %v", err)
+        }
+        defer rmsg.Release()
+        if rmsg.Seqno() != seq || rmsg.SerializeType() != styp || rmsg.ServiceMethod() != method {
+            t.Fatalf("head mismatch: seqno %v, styp %v, method %q", rmsg.Seqno(), rmsg.SerializeType(), rmsg.ServiceMethod())
+        }
+        if rmsg.CompressKind() != msg.CompressKind() {
+            t.Fatalf("compress mismatch: %v %v", rmsg.CompressKind(), msg.CompressKind())
+        }
+        if code, errmsg := rmsg.RPCError(); code != ErrCodeNone {
+            t.Fatalf("unexpected rpc error %v %q", code, errmsg)
+        }
+        reply, value := newReply()
+        if err = rmsg.Unpack(s, reply); err != nil {
+            t.Fatalf("unpack: %v", err)
+        }
+        if !bytes.Equal(value(), payload) {
+            t.Fatalf("payload mismatch: %x %x", value(), payload)
+        }
+    })
+}
+
+//语料中的包，按文件名检查返回的错误
+func TestFuzzCorpus(t *testing.T) {
+    isBodyError := func(err error) bool {
+        _, ok := err.(*BodyError)
+        return ok
+    }
+    isEOF := func(err error) bool {
+        return err == io.EOF || err == io.ErrUnexpectedEOF
+    }
+    expects := map[string]func(err error) bool{
+        "empty":                isEOF,
+        "truncated_head":       isEOF,
+        "truncated_v3_head":    isEOF,
+        "truncated_body":       isEOF,
+        "oversized_length":     isEOF,
+        "bad_magic":            func(err error) bool { return err == ErrMagic },
+        "bad_version":          func(err error) bool { return err == ErrVersion },
+        "v3_without_styp":      func(err error) bool { return err == ErrVersion },
+        "length_under_head":    func(err error) bool { return err == ErrInvLength },
+        "method_len_overflow":  isBodyError,
+        "empty_method":         isBodyError,
+        "unknown_error_code":   isBodyError,
+        "unsupported_compress": isBodyError,
+        "corrupted_gzip":       isBodyError,
+        "gzip_bomb":            isBodyError,
+        "snappy_bomb":          isBodyError,
+        "zstd_bomb":            isBodyError,
+        "zstd_window":          isBodyError,
+        "legacy_bad_envelope":  isBodyError,
+        "legacy_error_payload": isBodyError,
+        //包合法，payload解码失败
+        "msgpack_map_key": func(err error) bool { return err != nil && !isBodyError(err) && !isEOF(err) },
+    }
+    dir := filepath.Join("testdata", "fuzz", "FuzzNewResponse")
+    files, err := ioutil.ReadDir(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(files) != len(expects) {
+        t.Fatalf("corpus has %v files, expects %v", len(files), len(expects))
+    }
+    for _, fi := range files {
+        expect, ok := expects[fi.Name()]
+        if !ok {
+            t.Fatalf("no expectation for corpus %v", fi.Name())
+        }
+        data := readCorpus(t, filepath.Join(dir, fi.Name()))
+        var err error
+        n := allocBytes(func() {
+            var rmsg *Message
+            rmsg, err = NewResponseLimit(bytes.NewReader(data), fuzzLimit)
+            if err == nil {
+                var v interface{}
+                err = rmsg.Unpack(codec.GetSerializer(codec.SerializeTypeMsgpack), &v)
+                rmsg.Release()
+            }
+        })
+        if !expect(err) {
+            t.Errorf("%v: unexpected error %v", fi.Name(), err)
+        }
+        if n > fuzzMaxAlloc {
+            t.Errorf("%v: %v bytes allocated", fi.Name(), n)
+        }
+    }
+}
+
+//解析go test fuzz v1格式，只有一个[]byte参数
+func readCorpus(t *testing.T, path string) []byte {
+    content, err := ioutil.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    lines := strings.SplitN(strings.TrimSpace(string(content)), "\n", 2)
+    if len(lines) != 2 || lines[0] != "go test fuzz v1" ||
+        !strings.HasPrefix(lines[1], "[]byte(") || !strings.HasSuffix(lines[1], ")") {
+        t.Fatalf("%v: invalid corpus", path)
+    }
+    s, err := strconv.Unquote(strings.TrimSuffix(strings.TrimPrefix(lines[1], "[]byte("), ")"))
+    if err != nil {
+        t.Fatalf("%v: %v", path, err)
+    }
+    return []byte(s)
+}
@@ -1,14 +1,16 @@
 package message
 
 import (
+    "bytes"
     "encoding/binary"
     "errors"
     "fmt"
     "io"
+    "sync"
     //"encoding/hex"
 
     "github.com/philipyao/prpc/codec"
-    "github.com/philipyao/toolbox/util"
+    "github.com/philipyao/prpc/compress"
 )
 
 type MsgKind byte
@@ -18,18 +20,31 @@ const (
     MsgKindHeartbeat                //心跳包
 )
 
-type CompressKind byte
+type CompressKind = compress.Kind
 
 const (
-    CompressKindNone CompressKind = iota
-    CompressKindGzip
+    CompressKindNone   = compress.None
+    CompressKindGzip   = compress.Gzip
+    CompressKindSnappy = compress.Snappy
+    CompressKindLZ4    = compress.LZ4
+    CompressKindZstd   = compress.Zstd
 )
 
 const (
     magicNumber = 9527
-    msgVersion  = 0xA1
+    msgVersion  = 0xA3 //head中带有payload的序列化方式，body为二进制格式
+    msgVersion1 = 0xA1 //旧版本，payload使用服务端的序列化方式，body为msgpack封装
 
-    DataCompressLen = 2048
+    //当前的包格式版本，节点注册时带上，客户端据此决定是否按旧版本打包
+    FrameVersion = msgVersion
+
+    headLen  = 9
+    headLen1 = 8
+
+    maxMsgLen    = 65535 //head中长度字段为2字节
+    MaxMethodLen = 255   //body中method长度为1字节
+
+    DataCompressLen = 2048 //默认的压缩阈值
 )
 
 var (
@@ -37,15 +52,51 @@ var (
     ErrVersion         = errors.New("version mismatch")
     ErrUnpackHeartbeat = errors.New("unpack heartbeart to rpc")
     ErrInvLength       = errors.New("invalid total msg length")
+    ErrMsgTooLarge     = errors.New("msg too large")
+    ErrMethodTooLong   = errors.New("service method too long")
+    ErrInvBody         = errors.New("invalid msg body")
 )
 
 var (
     seqno        = 0
     defaultCodec = codec.GetSerializer(codec.SerializeTypeMsgpack)
+
+    //打包和读取body的缓冲
+    bufPool = sync.Pool{
+        New: func() interface{} {
+            return new(bytes.Buffer)
+        },
+    }
+    zeroHead head
+
+    //默认的读包限制，客户端使用
+    DefaultLimit = Limit{
+        MaxDecompressLen: 4 << 20,
+        MaxMethodLen:     MaxMethodLen,
+    }
 )
 
-//magic(2) + ver(1) + len(2) + (msgkind+compresskind)(1) + seq(2)
-type head [8]byte
+//读包时的限制，数据来自对端，不能信任
+type Limit struct {
+    MaxDecompressLen int //解压后body的最大长度，<=0不限制
+    MaxMethodLen     int //ServiceMethod的最大长度，<=0不限制
+}
+
+//包已完整读出但body非法，如压缩方式不支持、解压失败、格式错误；
+//连接上的后续包依然可以读取，可按Seqno回复错误
+type BodyError struct {
+    Err error
+}
+
+func (e *BodyError) Error() string {
+    return e.Err.Error()
+}
+
+//magic(2) + ver(1) + len(2) + (msgkind+compresskind+acceptcompress)(1) + seq(2) + styp(1)
+//msgkind占最高位，compresskind占3~5位（gzip与旧版本的压缩标记一致），acceptcompress占0~2位
+//未指定styp时按旧版本打包，没有最后的styp
+//body: methodlen(1) + method + code(1) + payload，code非0时payload为错误信息
+type head [headLen]byte
 
 func (h *head) initHead(mk MsgKind, seq uint16) {
     binary.BigEndian.PutUint16(h[0:], uint16(magicNumber))
@@ -57,9 +108,32 @@ func (h *head) setLength(length int) {
     //65535，最大65k数据
     binary.BigEndian.PutUint16(h[3:], uint16(length))
 }
-func (h *head) setCompressed() {
-    ck := CompressKindGzip
-    h[5] |= ((byte(ck) << 3) & 0x08)
+//payload的序列化方式
+func (h *head) SetSerializeType(styp codec.SerializeType) {
+    h[8] = byte(styp)
+}
+func (h *head) SerializeType() codec.SerializeType {
+    return codec.SerializeType(h[8])
+}
+func (h *head) headLen() int {
+    if h.SerializeType() == codec.SerializeTypeNone {
+        return headLen1
+    }
+    return headLen
+}
+//body的压缩方式
+func (h *head) setCompressKind(ck CompressKind) {
+    h[5] = (h[5] &^ 0x38) | ((byte(ck) << 3) & 0x38)
+}
+func (h *head) CompressKind() CompressKind {
+    return CompressKind((h[5] & 0x38) >> 3)
+}
+//希望对端返回时使用的压缩方式，CompressKindNone表示未指定，对端按gzip压缩
+func (h *head) SetAcceptCompress(ck CompressKind) {
+    h[5] = (h[5] &^ 0x07) | (byte(ck) & 0x07)
+}
+func (h *head) AcceptCompress() CompressKind {
+    return CompressKind(h[5] & 0x07)
 }
 
 func (h *head) IsHeartbeat() bool {
@@ -72,10 +146,6 @@ func (h *head) IsDefault() bool {
     return mk == MsgKindDefault
 }
 
-func (h *head) isCompressed() bool {
-    ck := CompressKind((h[5] & 0x08) >> 3)
-    return ck == CompressKindGzip
-}
 func (h *head) magic() int {
     return int(binary.BigEndian.Uint16(h[0:]))
 }
@@ -92,84 +162,309 @@ func (h *head) length() int {
 type response struct {
     r   io.Reader
     rpc *msgRPC
+    buf *bytes.Buffer //body所在的缓冲，Release时归还
+
+    released bool
 }
 
 type Message struct {
     head
     *response
 
-    data []byte
+    data      []byte
+    compress  CompressKind //打包时body超过threshold使用的压缩方式
+    threshold int
 }
 
 type msgHeartbeat struct {
     Seqno uint `json:"seqno"`
 }
 
+//rpc返回的错误类型
+type ErrCode int
+
+const (
+    ErrCodeNone             ErrCode = iota
+    ErrCodeServer                   //handler返回的错误
+    ErrCodePermissionDenied         //没有调用权限
+
+    errCodeMax = ErrCodePermissionDenied
+)
+
+//旧版本的body
 type msgRPC struct {
-    ServiceMethod string `json:"service_method"`
-    Payload       []byte `json:"payload"` //rpc实际数据
+    ServiceMethod string  `json:"service_method"`
+    Payload       []byte  `json:"payload"`         //rpc实际数据
+    Code          ErrCode `json:"code,omitempty"`  //非0表示调用出错
+    Error         string  `json:"error,omitempty"` //错误信息
+}
+
+func getBuffer() *bytes.Buffer {
+    buf := bufPool.Get().(*bytes.Buffer)
+    buf.Reset()
+    return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+    bufPool.Put(buf)
 }
 
 func NewRequest(msgKind MsgKind, seqno uint16) *Message {
     msg := new(Message)
     msg.initHead(msgKind, seqno)
+    msg.SetCompress(CompressKindGzip, DataCompressLen)
     return msg
 }
 
+//打包时body超过threshold字节则使用ck压缩，threshold<=0使用默认阈值，CompressKindNone不压缩
+func (m *Message) SetCompress(ck CompressKind, threshold int) {
+    if threshold <= 0 {
+        threshold = DataCompressLen
+    }
+    m.compress = ck
+    m.threshold = threshold
+}
+
+//按DefaultLimit读取一个包
 func NewResponse(r io.Reader) (*Message, error) {
+    return NewResponseLimit(r, DefaultLimit)
+}
+
+//读取一个包，处理完后调用Release归还缓冲；
+//返回*BodyError时同时返回msg，只有head可用，可据此回复错误
+func NewResponseLimit(r io.Reader, limit Limit) (*Message, error) {
     msg := new(Message)
     msg.response = &response{r: r}
     err := msg.read()
+    if err == nil {
+        if err = msg.decode(limit); err != nil {
+            err = &BodyError{Err: err}
+        }
+    }
     if err != nil {
+        msg.Release()
+        if _, ok := err.(*BodyError); ok {
+            return msg, err
+        }
         return nil, err
     }
-    if msg.IsDefault() {
-        //如果是默认（rpc）包，解析出method
-        msg.response.rpc = new(msgRPC)
-        err = defaultCodec.Decode(msg.data, msg.response.rpc)
+    return msg, nil
+}
+
+//解压并解析body
+func (m *Message) decode(limit Limit) error {
+    if ck := m.CompressKind(); ck != CompressKindNone {
+        c := compress.Get(ck)
+        if c == nil {
+            return &compress.UnsupportedError{Kind: ck}
+        }
+        data, err := c.Decompress(m.data, limit.MaxDecompressLen)
         if err != nil {
-            return nil, fmt.Errorf("decode body error %v", err)
+            return fmt.Errorf("decompress %v: %v", ck, err)
         }
+        //fmt.Printf("unpack after decompress: body len %v\n", len(data))
+        m.data = data
+    }
+    if !m.IsDefault() {
+        return nil
+    }
+    //如果是默认（rpc）包，解析出method
+    var rpc *msgRPC
+    var err error
+    if m.headLen() == headLen1 {
+        rpc = new(msgRPC)
+        err = defaultCodec.Decode(m.data, rpc)
+    } else {
+        rpc, err = decodeBody(m.data)
+    }
+    if err != nil {
+        return fmt.Errorf("decode body error %v", err)
+    }
+    if err = rpc.validate(limit); err != nil {
+        return err
+    }
+    m.response.rpc = rpc
+    return nil
+}
 
+//旧版本的body由对端的msgpack解出，各字段都需要检查
+func (rpc *msgRPC) validate(limit Limit) error {
+    if limit.MaxMethodLen > 0 && len(rpc.ServiceMethod) > limit.MaxMethodLen {
+        return ErrMethodTooLong
     }
-    return msg, nil
+    if rpc.Code < ErrCodeNone || rpc.Code > errCodeMax {
+        return fmt.Errorf("%v: unknown error code %v", ErrInvBody, rpc.Code)
+    }
+    if rpc.Code == ErrCodeNone {
+        //正常的包必须带有method，不能带有错误信息
+        if rpc.ServiceMethod == "" || rpc.Error != "" {
+            return ErrInvBody
+        }
+    } else if len(rpc.Payload) != 0 {
+        return ErrInvBody
+    }
+    return nil
+}
+
+func decodeBody(data []byte) (*msgRPC, error) {
+    if len(data) < 2 {
+        return nil, ErrInvBody
+    }
+    mlen := int(data[0])
+    if len(data) < 1+mlen+1 {
+        return nil, ErrInvBody
+    }
+    rpc := &msgRPC{
+        ServiceMethod: string(data[1 : 1+mlen]),
+        Code:          ErrCode(data[1+mlen]),
+    }
+    rest := data[1+mlen+1:]
+    if rpc.Code == ErrCodeNone {
+        rpc.Payload = rest
+    } else {
+        rpc.Error = string(rest)
+    }
+    return rpc, nil
 }
 
 //将v序列化为payload，并添加head后打包成二进制
 func (m *Message) Pack(serviceMethod string, v interface{}, s codec.Serializer) ([]byte, error) {
+    buf := new(bytes.Buffer)
+    if err := m.pack(buf, serviceMethod, ErrCodeNone, "", v, s); err != nil {
+        return nil, err
+    }
+    m.data = buf.Bytes()
+    return m.data, nil
+}
+
+//打包错误返回，没有payload
+func (m *Message) PackError(serviceMethod string, code ErrCode, errmsg string) ([]byte, error) {
+    if code == ErrCodeNone {
+        return nil, errors.New("pack error with no error code")
+    }
+    buf := new(bytes.Buffer)
+    if err := m.pack(buf, serviceMethod, code, errmsg, nil, nil); err != nil {
+        return nil, err
+    }
+    m.data = buf.Bytes()
+    return m.data, nil
+}
+
+//同Pack，使用池化的缓冲打包后一次写入w
+func (m *Message) PackTo(w io.Writer, serviceMethod string, v interface{}, s codec.Serializer) error {
+    buf := getBuffer()
+    defer putBuffer(buf)
+    if err := m.pack(buf, serviceMethod, ErrCodeNone, "", v, s); err != nil {
+        return err
+    }
+    _, err := w.Write(buf.Bytes())
+    return err
+}
+
+//同PackError，使用池化的缓冲打包后一次写入w
+func (m *Message) PackErrorTo(w io.Writer, serviceMethod string, code ErrCode, errmsg string) error {
+    if code == ErrCodeNone {
+        return errors.New("pack error with no error code")
+    }
+    buf := getBuffer()
+    defer putBuffer(buf)
+    if err := m.pack(buf, serviceMethod, code, errmsg, nil, nil); err != nil {
+        return err
+    }
+    _, err := w.Write(buf.Bytes())
+    return err
+}
+
+//先预留head，body直接写在head之后，最后回填head
+func (m *Message) pack(buf *bytes.Buffer, serviceMethod string, code ErrCode, errmsg string, v interface{}, s codec.Serializer) error {
+    hlen := m.headLen()
+    buf.Write(zeroHead[:hlen])
+    var err error
+    if hlen == headLen1 {
+        m.head[2] = byte(msgVersion1)
+        err = packBody1(buf, serviceMethod, code, errmsg, v, s)
+    } else {
+        m.head[2] = byte(msgVersion)
+        err = packBody(buf, serviceMethod, code, errmsg, v, s)
+    }
+    if err != nil {
+        return err
+    }
+    ck := m.compress
+    if hlen == headLen1 && ck != CompressKindNone {
+        //旧版本只支持gzip
+        ck = CompressKindGzip
+    }
+    m.setCompressKind(CompressKindNone)
+    if ck != CompressKindNone && buf.Len()-hlen > m.threshold {
+        c := compress.Get(ck)
+        if c == nil {
+            return &compress.UnsupportedError{Kind: ck}
+        }
+        body, err := c.Compress(buf.Bytes()[hlen:])
+        if err != nil {
+            return err
+        }
+        m.setCompressKind(ck)
+        buf.Truncate(hlen)
+        buf.Write(body)
+    }
+    dlen := buf.Len()
+    if dlen > maxMsgLen {
+        return ErrMsgTooLarge
+    }
+    //pack head len
+    m.setLength(dlen)
+    copy(buf.Bytes(), m.head[:hlen])
+    return nil
+}
+
+func packBody(buf *bytes.Buffer, serviceMethod string, code ErrCode, errmsg string, v interface{}, s codec.Serializer) error {
+    if len(serviceMethod) > MaxMethodLen {
+        return ErrMethodTooLong
+    }
+    buf.WriteByte(byte(len(serviceMethod)))
+    buf.WriteString(serviceMethod)
+    buf.WriteByte(byte(code))
+    if code != ErrCodeNone {
+        buf.WriteString(errmsg)
+        return nil
+    }
+    if e, ok := s.(codec.StreamEncoder); ok {
+        return e.EncodeTo(buf, v)
+    }
     payload, err := s.Encode(v)
     if err != nil {
-        return nil, err
+        return err
     }
+    buf.Write(payload)
+    return nil
+}
 
+//旧版本payload序列化后再用msgpack封装
+func packBody1(buf *bytes.Buffer, serviceMethod string, code ErrCode, errmsg string, v interface{}, s codec.Serializer) error {
     rpc := &msgRPC{
         ServiceMethod: serviceMethod,
-        Payload:       payload,
+        Code:          code,
+        Error:         errmsg,
+    }
+    if code == ErrCodeNone {
+        payload, err := s.Encode(v)
+        if err != nil {
+            return err
+        }
+        rpc.Payload = payload
     }
     body, err := defaultCodec.Encode(rpc)
     if err != nil {
-        return nil, err
-    }
-    //fmt.Printf("body len: %v\n", len(body))
-    if len(body) > DataCompressLen {
-        m.setCompressed()
-        body = util.Compress(body)
-        //fmt.Printf("pack after compress: body len %v\n", len(body))
+        return err
     }
-    hlen := len(m.head)
-    dlen := hlen + len(body)
-    m.data = make([]byte, dlen)
-    //pack head len
-    m.setLength(dlen)
-    //fmt.Printf("head %s\n", hex.EncodeToString((m.head[:])))
-    //fmt.Printf("body %s\n", hex.EncodeToString(body))
-    copy(m.data[0:], m.head[:])
-    copy(m.data[hlen:], body)
-    return m.data, nil
+    buf.Write(body)
+    return nil
 }
 
 func (m *Message) unpackHead() error {
-    _, err := io.ReadFull(m.response.r, m.head[:])
+    _, err := io.ReadFull(m.response.r, m.head[:headLen1])
     if err != nil {
         return err
     }
@@ -177,12 +472,23 @@ func (m *Message) unpackHead() error {
     if m.magic() != magicNumber {
         return ErrMagic
     }
-    if m.version() != msgVersion {
+    switch m.version() {
+    case msgVersion:
+        _, err = io.ReadFull(m.response.r, m.head[headLen1:])
+        if err != nil {
+            return err
+        }
+        if m.SerializeType() == codec.SerializeTypeNone {
+            return ErrVersion
+        }
+    case msgVersion1:
+        m.SetSerializeType(codec.SerializeTypeNone)
+    default:
         return ErrVersion
     }
     length := m.length()
-    //fmt.Printf("length: %d, hlen %v\n", length, len(m.head))
-    if length <= len(m.head) {
+    //fmt.Printf("length: %d, hlen %v\n", length, m.headLen())
+    if length <= m.headLen() {
         return ErrInvLength
     }
     return nil
@@ -196,20 +502,35 @@ func (m *Message) read() error {
         return err
     }
     //read body
-    lenBody := m.length() - len(m.head)
-    m.data = make([]byte, lenBody)
+    lenBody := m.length() - m.headLen()
+    buf := getBuffer()
+    buf.Grow(lenBody)
+    m.response.buf = buf
+    m.data = buf.Bytes()[:lenBody]
     _, err = io.ReadFull(m.response.r, m.data)
     if err != nil {
         return err
     }
     //fmt.Printf("unpack: body len %v\n", lenBody)
-    if m.isCompressed() {
-        m.data = util.Decompress(m.data)
-        //fmt.Printf("unpack after decompress: body len %v\n", len(m.data))
-    }
     return nil
 }
 
+//归还body缓冲，之后不能再Unpack；ServiceMethod和RPCError依然可用
+func (m *Message) Release() {
+    if m.response == nil || m.response.released {
+        return
+    }
+    m.response.released = true
+    if m.response.buf != nil {
+        putBuffer(m.response.buf)
+        m.response.buf = nil
+    }
+    m.data = nil
+    if m.response.rpc != nil {
+        m.response.rpc.Payload = nil
+    }
+}
+
 //获取rpc的ServiceMethod
 func (m *Message) ServiceMethod() string {
     if m.IsHeartbeat() {
@@ -222,6 +543,14 @@ func (m *Message) ServiceMethod() string {
     return ""
 }
 
+//rpc返回的错误，ErrCodeNone表示成功
+func (m *Message) RPCError() (ErrCode, string) {
+    if m.response == nil || m.response.rpc == nil {
+        return ErrCodeNone, ""
+    }
+    return m.response.rpc.Code, m.response.rpc.Error
+}
+
 //把payload反序列化出来
 func (m *Message) Unpack(s codec.Serializer, v interface{}) error {
     if m.IsHeartbeat() {
@@ -230,8 +559,12 @@ func (m *Message) Unpack(s codec.Serializer, v interface{}) error {
     if m.response == nil || m.response.rpc == nil {
         return errors.New("no rpc found")
     }
-    if len(m.response.rpc.Payload) == 0 {
-        return errors.New("empty rpc payload")
+    if m.response.released {
+        return errors.New("unpack released msg")
+    }
+    //payload可以为空，如protobuf的空消息
+    if m.response.rpc.Code != ErrCodeNone {
+        return errors.New("unpack error reply")
     }
     return s.Decode(m.response.rpc.Payload, v)
 }
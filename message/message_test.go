@@ -2,8 +2,12 @@ package message
 
 import (
     "bytes"
-    "github.com/philipyao/prpc/codec"
+    "math/rand"
+    "strings"
     "testing"
+
+    "github.com/philipyao/prpc/codec"
+    "github.com/philipyao/prpc/compress"
 )
 
 var (
@@ -129,3 +133,354 @@ func TestRpcCompress(t *testing.T) {
 func TestHeartbeat(t *testing.T) {
 
 }
+
+func TestRpcError(t *testing.T) {
+    msg := NewRequest(MsgKindDefault, 3)
+    if _, err := msg.PackError(serviceMethod, ErrCodeNone, "oops"); err == nil {
+        t.Fatal("pack error without code")
+    }
+    data, err := msg.PackError(serviceMethod, ErrCodePermissionDenied, "denied")
+    if err != nil {
+        t.Fatal(err)
+    }
+    rmsg, err := NewResponse(bytes.NewReader(data))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if rmsg.Seqno() != 3 || rmsg.ServiceMethod() != serviceMethod {
+        t.Fatalf("unexpected msg seqno %v, method %v", rmsg.Seqno(), rmsg.ServiceMethod())
+    }
+    if code, errmsg := rmsg.RPCError(); code != ErrCodePermissionDenied || errmsg != "denied" {
+        t.Fatalf("unexpected rpc error %v %q", code, errmsg)
+    }
+
+    //正常返回没有错误
+    s := codec.GetSerializer(codec.SerializeTypeMsgpack)
+    data, err = NewRequest(MsgKindDefault, 4).Pack(serviceMethod, 1, s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    rmsg, err = NewResponse(bytes.NewReader(data))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if code, _ := rmsg.RPCError(); code != ErrCodeNone {
+        t.Fatalf("unexpected rpc error %v", code)
+    }
+}
+
+func TestHeadSerializeType(t *testing.T) {
+    s := codec.GetSerializer(codec.SerializeTypeJson)
+    msg := NewRequest(MsgKindDefault, 5)
+    msg.SetSerializeType(codec.SerializeTypeJson)
+    data, err := msg.Pack(serviceMethod, "hello", s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if data[2] != msgVersion {
+        t.Fatalf("unexpected version %x", data[2])
+    }
+    rmsg, err := NewResponse(bytes.NewReader(data))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if rmsg.SerializeType() != codec.SerializeTypeJson || rmsg.Seqno() != 5 {
+        t.Fatalf("unexpected styp %v, seqno %v", rmsg.SerializeType(), rmsg.Seqno())
+    }
+    var text string
+    if err := rmsg.Unpack(s, &text); err != nil || text != "hello" {
+        t.Fatalf("unpack: %q %v", text, err)
+    }
+
+    //未指定序列化方式时按旧版本打包，兼容旧的客户端
+    data1, err := NewRequest(MsgKindDefault, 6).Pack(serviceMethod, "hello", s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if data1[2] != msgVersion1 {
+        t.Fatalf("unexpected v1 frame: version %x, len %v", data1[2], len(data1))
+    }
+    rmsg, err = NewResponse(bytes.NewReader(data1))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if rmsg.SerializeType() != codec.SerializeTypeNone || rmsg.Seqno() != 6 {
+        t.Fatalf("unexpected styp %v, seqno %v", rmsg.SerializeType(), rmsg.Seqno())
+    }
+
+    //新版本必须携带序列化方式
+    data[8] = byte(codec.SerializeTypeNone)
+    if _, err := NewResponse(bytes.NewReader(data)); err != ErrVersion {
+        t.Fatalf("frame without styp: %v", err)
+    }
+    data[2] = 0xA2
+    if _, err := NewResponse(bytes.NewReader(data)); err != ErrVersion {
+        t.Fatalf("unknown version: %v", err)
+    }
+}
+
+func TestPackTo(t *testing.T) {
+    s := codec.GetSerializer(codec.SerializeTypeMsgpack)
+    msg := NewRequest(MsgKindDefault, 7)
+    msg.SetSerializeType(codec.SerializeTypeMsgpack)
+    data, err := msg.Pack(serviceMethod, []int{1, 2, 3}, s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var w bytes.Buffer
+    msg = NewRequest(MsgKindDefault, 7)
+    msg.SetSerializeType(codec.SerializeTypeMsgpack)
+    if err = msg.PackTo(&w, serviceMethod, []int{1, 2, 3}, s); err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(data, w.Bytes()) {
+        t.Fatalf("PackTo mismatch Pack:\n%x\n%x", data, w.Bytes())
+    }
+
+    //method长度前缀之后紧跟payload，没有再次封装
+    payload, _ := s.Encode([]int{1, 2, 3})
+    if len(data) != headLen+1+len(serviceMethod)+1+len(payload) {
+        t.Fatalf("unexpected frame len %v", len(data))
+    }
+
+    rmsg, err := NewResponse(&w)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var v []int
+    if err = rmsg.Unpack(s, &v); err != nil || len(v) != 3 {
+        t.Fatalf("unpack %v %v", v, err)
+    }
+    rmsg.Release()
+    if rmsg.ServiceMethod() != serviceMethod || rmsg.Seqno() != 7 {
+        t.Fatalf("unexpected method %v, seqno %v after release", rmsg.ServiceMethod(), rmsg.Seqno())
+    }
+    if err = rmsg.Unpack(s, &v); err == nil {
+        t.Fatal("unpack after release")
+    }
+
+    //错误返回
+    w.Reset()
+    msg = NewRequest(MsgKindDefault, 8)
+    msg.SetSerializeType(codec.SerializeTypeMsgpack)
+    if err = msg.PackErrorTo(&w, serviceMethod, ErrCodeServer, "oops"); err != nil {
+        t.Fatal(err)
+    }
+    rmsg, err = NewResponse(&w)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if code, errmsg := rmsg.RPCError(); code != ErrCodeServer || errmsg != "oops" {
+        t.Fatalf("unexpected rpc error %v %q", code, errmsg)
+    }
+}
+
+func TestPackLimit(t *testing.T) {
+    s := codec.GetSerializer(codec.SerializeTypeMsgpack)
+    msg := NewRequest(MsgKindDefault, 1)
+    msg.SetSerializeType(codec.SerializeTypeMsgpack)
+    if _, err := msg.Pack(strings.Repeat("a", MaxMethodLen+1), 1, s); err != ErrMethodTooLong {
+        t.Fatalf("long method: %v", err)
+    }
+    //随机数据压缩后依然超出长度
+    big := make([]byte, maxMsgLen)
+    rand.Read(big)
+    if _, err := msg.Pack(serviceMethod, big, s); err != ErrMsgTooLarge {
+        t.Fatalf("large msg: %v", err)
+    }
+
+    //body不完整
+    data, err := msg.Pack(serviceMethod, 1, s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    data[headLen] = byte(len(data))
+    if _, err := NewResponse(bytes.NewReader(data)); err == nil {
+        t.Fatal("truncated body accepted")
+    }
+}
+
+type benchArgs struct {
+    A    int      `json:"a"`
+    B    int      `json:"b"`
+    Tags []string `json:"tags"`
+}
+
+func benchmarkRoundTrip(b *testing.B, styp codec.SerializeType, pooled bool) {
+    s := codec.GetSerializer(codec.SerializeTypeMsgpack)
+    args := &benchArgs{A: 7, B: 8, Tags: []string{"zone1001", "arith"}}
+    var w bytes.Buffer
+    b.ReportAllocs()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        w.Reset()
+        msg := NewRequest(MsgKindDefault, uint16(i))
+        msg.SetSerializeType(styp)
+        if pooled {
+            if err := msg.PackTo(&w, serviceMethod, args, s); err != nil {
+                b.Fatal(err)
+            }
+        } else {
+            data, err := msg.Pack(serviceMethod, args, s)
+            if err != nil {
+                b.Fatal(err)
+            }
+            w.Write(data)
+        }
+        rmsg, err := NewResponse(&w)
+        if err != nil {
+            b.Fatal(err)
+        }
+        var rargs benchArgs
+        if err = rmsg.Unpack(s, &rargs); err != nil {
+            b.Fatal(err)
+        }
+        if pooled {
+            rmsg.Release()
+        }
+    }
+}
+
+//旧版本：payload再经过msgpack封装
+func BenchmarkRoundTripV1(b *testing.B) {
+    benchmarkRoundTrip(b, codec.SerializeTypeNone, false)
+}
+
+func BenchmarkRoundTrip(b *testing.B) {
+    benchmarkRoundTrip(b, codec.SerializeTypeMsgpack, false)
+}
+
+func BenchmarkRoundTripPooled(b *testing.B) {
+    benchmarkRoundTrip(b, codec.SerializeTypeMsgpack, true)
+}
+
+func TestCompressKind(t *testing.T) {
+    s := codec.GetSerializer(codec.SerializeTypeMsgpack)
+    text := strings.Repeat("compress ", 64)
+    for _, ck := range []CompressKind{CompressKindNone, CompressKindGzip, CompressKindSnappy, CompressKindLZ4, CompressKindZstd} {
+        msg := NewRequest(MsgKindDefault, 1)
+        msg.SetSerializeType(codec.SerializeTypeMsgpack)
+        msg.SetCompress(ck, 128)
+        msg.SetAcceptCompress(CompressKindZstd)
+        data, err := msg.Pack(serviceMethod, text, s)
+        if err != nil {
+            t.Fatalf("%v pack: %v", ck, err)
+        }
+        rmsg, err := NewResponse(bytes.NewReader(data))
+        if err != nil {
+            t.Fatalf("%v NewResponse: %v", ck, err)
+        }
+        if rmsg.CompressKind() != ck || rmsg.AcceptCompress() != CompressKindZstd || !rmsg.IsDefault() {
+            t.Fatalf("%v: unexpected head compress %v, accept %v", ck, rmsg.CompressKind(), rmsg.AcceptCompress())
+        }
+        var rtext string
+        if err = rmsg.Unpack(s, &rtext); err != nil || rtext != text {
+            t.Fatalf("%v unpack: %v", ck, err)
+        }
+    }
+
+    //未超过阈值不压缩
+    msg := NewRequest(MsgKindDefault, 1)
+    msg.SetSerializeType(codec.SerializeTypeMsgpack)
+    msg.SetCompress(CompressKindZstd, 4096)
+    data, err := msg.Pack(serviceMethod, text, s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if msg.CompressKind() != CompressKindNone {
+        t.Fatalf("compressed below threshold: %v", msg.CompressKind())
+    }
+
+    //旧版本只支持gzip，与原有的压缩标记一致
+    msg = NewRequest(MsgKindDefault, 1)
+    msg.SetCompress(CompressKindZstd, 128)
+    data, err = msg.Pack(serviceMethod, text, s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if data[5] != 0x08 {
+        t.Fatalf("unexpected v1 flags %x", data[5])
+    }
+
+    //不支持的压缩方式
+    msg = NewRequest(MsgKindDefault, 11)
+    msg.SetSerializeType(codec.SerializeTypeMsgpack)
+    data, err = msg.Pack(serviceMethod, text, s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    data[5] |= 7 << 3
+    rmsg, err := NewResponse(bytes.NewReader(data))
+    if berr, ok := err.(*BodyError); !ok {
+        t.Fatalf("unexpected error %v", err)
+    } else if _, ok := berr.Err.(*compress.UnsupportedError); !ok {
+        t.Fatalf("unexpected body error %v", berr.Err)
+    }
+    if rmsg == nil || rmsg.Seqno() != 11 {
+        t.Fatal("msg head not returned with unsupported compress")
+    }
+    msg.SetCompress(7, 128)
+    if _, err = msg.Pack(serviceMethod, text, s); err == nil {
+        t.Fatal("pack with unsupported compress")
+    }
+}
+
+func TestLimit(t *testing.T) {
+    s := codec.GetSerializer(codec.SerializeTypeMsgpack)
+    limit := Limit{MaxDecompressLen: 64 << 10, MaxMethodLen: 16}
+    expectBodyError := func(data []byte, name string) error {
+        rmsg, err := NewResponseLimit(bytes.NewReader(data), limit)
+        berr, ok := err.(*BodyError)
+        if !ok || rmsg == nil {
+            t.Fatalf("%v: unexpected error %v", name, err)
+        }
+        return berr.Err
+    }
+
+    //压缩炸弹：压缩后很小，解压后超出限制
+    for _, ck := range []CompressKind{CompressKindGzip, CompressKindSnappy, CompressKindLZ4, CompressKindZstd} {
+        msg := NewRequest(MsgKindDefault, 1)
+        msg.SetSerializeType(codec.SerializeTypeMsgpack)
+        msg.SetCompress(ck, 0)
+        data, err := msg.Pack(serviceMethod, make([]byte, 1<<20), s)
+        if err != nil {
+            if ck == CompressKindSnappy && err == ErrMsgTooLarge {
+                //snappy压缩率有限，无法放入一个包
+                continue
+            }
+            t.Fatalf("%v pack: %v", ck, err)
+        }
+        if err := expectBodyError(data, ck.String()); !strings.Contains(err.Error(), compress.ErrTooLarge.Error()) {
+            t.Fatalf("%v bomb: %v", ck, err)
+        }
+    }
+
+    //method超出限制
+    msg := NewRequest(MsgKindDefault, 1)
+    msg.SetSerializeType(codec.SerializeTypeMsgpack)
+    data, err := msg.Pack("Service.VeryLongMethodName", 1, s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := expectBodyError(data, "long method"); err != ErrMethodTooLong {
+        t.Fatalf("long method: %v", err)
+    }
+
+    //旧版本的msgpack封装需要校验
+    for name, rpc := range map[string]*msgRPC{
+        "empty method":  {Payload: []byte{1}},
+        "error no code": {ServiceMethod: serviceMethod, Error: "oops"},
+        "unknown code":  {ServiceMethod: serviceMethod, Code: errCodeMax + 1, Error: "oops"},
+        "error payload": {ServiceMethod: serviceMethod, Code: ErrCodeServer, Payload: []byte{1}},
+    } {
+        body, err := defaultCodec.Encode(rpc)
+        if err != nil {
+            t.Fatal(err)
+        }
+        msg := NewRequest(MsgKindDefault, 2)
+        msg.head[2] = msgVersion1
+        msg.setLength(headLen1 + len(body))
+        data := append(append([]byte(nil), msg.head[:headLen1]...), body...)
+        expectBodyError(data, name)
+    }
+}
@@ -32,9 +32,16 @@ func (id *ID) Load(s string) error {
 
 // service可选配置项
 type NodeOption struct {
-    Weight  int    `json:"weight"`  //权重, 默认10
-    Styp    int    `json:"styp"`    //序列化, 默认messagepack
-    Version string `json:"version"` //灰度版本，默认为空
+    Weight   int    `json:"weight"`             //权重, 默认10
+    Styp     int    `json:"styp"`               //序列化, 默认messagepack
+    Version  string `json:"version"`            //灰度版本，默认为空
+    Disabled bool   `json:"disabled,omitempty"` //禁用后客户端不再选取，用于摘流量
+    TLS      bool   `json:"tls,omitempty"`      //节点只接受TLS连接
+
+    Compress []string `json:"compress,omitempty"` //节点支持的压缩方式，为空表示只支持gzip
+    Frame    int      `json:"frame,omitempty"`    //节点支持的包格式版本，为0表示只支持旧版本
+
+    Labels map[string]string `json:"labels,omitempty"` //自定义标签，如region、idc
 }
 
 // service node定义
@@ -55,7 +62,7 @@ func (node *Node) decode(data []byte) error {
 func (node *Node) key() string {
     return node.ID.Dump()
 }
-func (node *Node) decorate(opts ...fnOptionNode) error {
+func (node *Node) decorate(opts ...FnOptionNode) error {
     for n, fnOpt := range opts {
         if fnOpt == nil {
             return fmt.Errorf("[registry] err: decorate node, nil option no.%v", n+1)
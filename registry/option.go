@@ -10,9 +10,9 @@ const (
 )
 
 //服务注册修饰项
-type fnOptionNode func(node *Node) error
+type FnOptionNode func(node *Node) error
 
-func WithWeight(weight int) fnOptionNode {
+func WithWeight(weight int) FnOptionNode {
     if weight < 0 || weight > maxWeight {
         log.Println("[registry] invalid weight value")
         return nil
@@ -22,13 +22,13 @@ func WithWeight(weight int) fnOptionNode {
         return nil
     }
 }
-func WithSerialize(styp codec.SerializeType) fnOptionNode {
+func WithSerialize(styp codec.SerializeType) FnOptionNode {
     return func(node *Node) error {
         node.Styp = int(styp)
         return nil
     }
 }
-func WithVersion(version string) fnOptionNode {
+func WithVersion(version string) FnOptionNode {
     if version == "" {
         log.Println("[registry] empty version not allowed")
         return nil
@@ -38,3 +38,42 @@ func WithVersion(version string) fnOptionNode {
         return nil
     }
 }
+func WithDisabled(disabled bool) FnOptionNode {
+    return func(node *Node) error {
+        node.Disabled = disabled
+        return nil
+    }
+}
+func WithLabels(labels map[string]string) FnOptionNode {
+    for k := range labels {
+        if k == "" {
+            log.Println("[registry] empty label key not allowed")
+            return nil
+        }
+    }
+    return func(node *Node) error {
+        node.Labels = make(map[string]string, len(labels))
+        for k, v := range labels {
+            node.Labels[k] = v
+        }
+        return nil
+    }
+}
+func WithTLS(enable bool) FnOptionNode {
+    return func(node *Node) error {
+        node.TLS = enable
+        return nil
+    }
+}
+func WithFrame(version int) FnOptionNode {
+    return func(node *Node) error {
+        node.Frame = version
+        return nil
+    }
+}
+func WithCompress(names []string) FnOptionNode {
+    return func(node *Node) error {
+        node.Compress = append([]string(nil), names...)
+        return nil
+    }
+}
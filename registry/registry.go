@@ -59,9 +59,7 @@ func New(zkAddr string) *Registry {
     return r
 }
 
-//服务提供方（server）在注册中心注册服务节点
-func (r *Registry) Register(service, group string, index int, addr string, opts ...fnOptionNode) error {
-    //todo check args
+func newNode(group string, index int, addr string, opts ...FnOptionNode) (*Node, error) {
     node := &Node{
         ID: ID{
             Group: group,
@@ -76,6 +74,16 @@ func (r *Registry) Register(service, group string, index int, addr string, opts
     }
     //修饰
     err := node.decorate(opts...)
+    if err != nil {
+        return nil, err
+    }
+    return node, nil
+}
+
+//服务提供方（server）在注册中心注册服务节点
+func (r *Registry) Register(service, group string, index int, addr string, opts ...FnOptionNode) error {
+    //todo check args
+    node, err := newNode(group, index, addr, opts...)
     if err != nil {
         return err
     }
@@ -113,6 +121,22 @@ func (r *Registry) Register(service, group string, index int, addr string, opts
     return nil
 }
 
+//服务提供方（server）在线更新已注册节点的数据，如权重、版本，订阅方会收到OnNodeChange
+func (r *Registry) Update(service, group string, index int, addr string, opts ...FnOptionNode) error {
+    node, err := newNode(group, index, addr, opts...)
+    if err != nil {
+        return err
+    }
+    nodeData, err := node.encode()
+    if err != nil {
+        log.Printf("[registry] encode node<%+v> err %v", node, err)
+        return err
+    }
+    log.Printf("[registry] try to update service(%v): %v, %v",
+        service, node.key(), string(nodeData))
+    return r.rt.SetServiceNode(makeServiceKey(service, group), node.key(), nodeData)
+}
+
 //服务提供方（server）在注册中心注销服务节点
 func (r *Registry) Unregister(service, group string, index int) error {
     return r.rt.DeleteServiceNode(makeServiceKey(service, group), fmt.Sprintf("%v.%v", group, index))
@@ -29,6 +29,9 @@ type remote interface {
     //获取节点
     GetServiceNode(string, string) ([]byte, error)
 
+    //更新节点数据
+    SetServiceNode(string, string, []byte) error
+
     //注销服务节点
     DeleteServiceNode(string, string) error
 
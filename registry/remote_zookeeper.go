@@ -129,6 +129,24 @@ func (rz *remoteZooKeeper) GetServiceNode(service, key string) ([]byte, error) {
     return rz.client.Get(nodePath)
 }
 
+func (rz *remoteZooKeeper) SetServiceNode(service, key string, data []byte) error {
+    nodePath := makePath(defaultZKRootPath, service, key)
+    //节点不存在说明尚未注册，或者已经过期被删除
+    exist, err := rz.client.Exists(nodePath)
+    if err != nil {
+        return err
+    }
+    if !exist {
+        return fmt.Errorf("service node %v not exist", nodePath)
+    }
+    err = rz.client.Set(nodePath, data)
+    if err != nil {
+        return err
+    }
+    log.Printf("[registry] set service node %v ok", nodePath)
+    return nil
+}
+
 func (rz *remoteZooKeeper) DeleteServiceNode(service, key string) error {
     var err error
     servicePath := makePath(defaultZKRootPath, service)
@@ -0,0 +1,87 @@
+package server
+
+import (
+    "context"
+    "errors"
+    "log"
+)
+
+//访问控制，返回false拒绝调用；peer中带有认证得到的Principal和TLS证书身份
+type ACL func(ctx context.Context, peer *Peer) bool
+
+//允许拥有任一角色的调用方
+func AllowRoles(roles ...string) ACL {
+    return func(ctx context.Context, peer *Peer) bool {
+        if peer.Principal == nil {
+            return false
+        }
+        for _, role := range roles {
+            if peer.Principal.HasRole(role) {
+                return true
+            }
+        }
+        return false
+    }
+}
+
+//允许指定身份的调用方：认证得到的Principal名字，或TLS证书的身份
+func AllowNames(names ...string) ACL {
+    return func(ctx context.Context, peer *Peer) bool {
+        for _, name := range names {
+            if peer.Principal != nil && peer.Principal.Name == name {
+                return true
+            }
+            if id := peer.Identity(); id != "" && id == name {
+                return true
+            }
+        }
+        return false
+    }
+}
+
+//Handle 修饰项
+type FnOptionHandle func(s *service) error
+
+func WithACL(acl ACL) FnOptionHandle {
+    //整个service的访问控制
+    if acl == nil {
+        log.Println("nil acl")
+        return nil
+    }
+    return func(s *service) error {
+        s.acl = acl
+        return nil
+    }
+}
+
+func WithMethodACL(method string, acl ACL) FnOptionHandle {
+    //方法级访问控制，优先于service级
+    if acl == nil {
+        log.Println("nil acl")
+        return nil
+    }
+    return func(s *service) error {
+        mtype := s.method[method]
+        if mtype == nil {
+            return errors.New("[rpc][error] acl for unknown method " + s.name + "." + method)
+        }
+        mtype.acl = acl
+        return nil
+    }
+}
+
+//检查调用方是否有权限调用该方法
+func (s *service) allow(ctx context.Context, mtype *methodType) bool {
+    acl := mtype.acl
+    if acl == nil {
+        acl = s.acl
+    }
+    if acl == nil {
+        return true
+    }
+    peer, ok := PeerFromContext(ctx)
+    if !ok {
+        return false
+    }
+    return acl(ctx, peer)
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+    "fmt"
+    "sync"
+)
+
+//内置的健康检查服务名，不在注册中心注册
+const HealthServiceName = "Health"
+
+type HealthStatus string
+
+const (
+    HealthServing        HealthStatus = "SERVING"
+    HealthNotServing     HealthStatus = "NOT_SERVING"
+    HealthServiceUnknown HealthStatus = "SERVICE_UNKNOWN"
+)
+
+//内置健康检查服务，随Server自动注册
+type healthService struct {
+    server *Server
+
+    lock     sync.RWMutex            //protect following
+    statuses map[string]HealthStatus //service -> status, ""表示整个server
+}
+
+func newHealthService(server *Server) *healthService {
+    return &healthService{
+        server:   server,
+        statuses: make(map[string]HealthStatus),
+    }
+}
+
+//查询服务状态，service为空时查询整个server的状态
+func (hs *healthService) Check(service string, reply *HealthStatus) error {
+    if service != "" {
+        if _, exist := hs.server.serviceMap[service]; !exist || service == HealthServiceName {
+            *reply = HealthServiceUnknown
+            return nil
+        }
+    }
+    hs.lock.RLock()
+    defer hs.lock.RUnlock()
+    //整个server不可用时，所有服务都不可用
+    if hs.statuses[""] == HealthNotServing {
+        *reply = HealthNotServing
+        return nil
+    }
+    *reply = HealthServing
+    if status, exist := hs.statuses[service]; exist {
+        *reply = status
+    }
+    return nil
+}
+
+func (hs *healthService) setStatus(service string, status HealthStatus) {
+    hs.lock.Lock()
+    defer hs.lock.Unlock()
+    hs.statuses[service] = status
+}
+
+//设置服务的健康状态(如维护期间设置为NOT_SERVING)，service为空时设置整个server
+func (s *Server) SetServingStatus(service string, status HealthStatus) error {
+    if status != HealthServing && status != HealthNotServing {
+        return fmt.Errorf("[rpc] invalid health status %v", status)
+    }
+    if service != "" {
+        if _, exist := s.serviceMap[service]; !exist || service == HealthServiceName {
+            return fmt.Errorf("[rpc] can't find service %v", service)
+        }
+    }
+    s.health.setStatus(service, status)
+    return nil
+}
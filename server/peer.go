@@ -0,0 +1,59 @@
+package server
+
+import (
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "net"
+
+    "github.com/philipyao/prpc/auth"
+)
+
+//连接对端的信息，handler通过 PeerFromContext 获取，用于鉴权
+type Peer struct {
+    Addr net.Addr
+    //TLS连接中对端证书经过校验后的证书链，叶子证书在前；非TLS或未校验客户端证书时为nil
+    Certificates []*x509.Certificate
+    //连接认证通过后的调用方身份，未开启认证时为nil
+    Principal *auth.Principal
+}
+
+//对端证书标识的身份：CommonName，没有时依次取DNS、URI SAN
+func (p *Peer) Identity() string {
+    if len(p.Certificates) == 0 {
+        return ""
+    }
+    leaf := p.Certificates[0]
+    switch {
+    case leaf.Subject.CommonName != "":
+        return leaf.Subject.CommonName
+    case len(leaf.DNSNames) > 0:
+        return leaf.DNSNames[0]
+    case len(leaf.URIs) > 0:
+        return leaf.URIs[0].String()
+    }
+    return ""
+}
+
+func newPeer(conn net.Conn) *Peer {
+    p := &Peer{Addr: conn.RemoteAddr()}
+    if tc, ok := conn.(*tls.Conn); ok {
+        state := tc.ConnectionState()
+        if len(state.VerifiedChains) > 0 {
+            p.Certificates = state.VerifiedChains[0]
+        }
+    }
+    return p
+}
+
+type peerKey struct{}
+
+func newPeerContext(ctx context.Context, p *Peer) context.Context {
+    return context.WithValue(ctx, peerKey{}, p)
+}
+
+//获取调用方信息，handler需要以 context.Context 作为第一个参数
+func PeerFromContext(ctx context.Context) (*Peer, bool) {
+    p, ok := ctx.Value(peerKey{}).(*Peer)
+    return p, ok
+}
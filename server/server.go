@@ -1,6 +1,8 @@
 package server
 
 import (
+    "context"
+    "crypto/tls"
     "errors"
     "fmt"
     "io"
@@ -9,13 +11,17 @@ import (
     "reflect"
     "strings"
     "sync"
+    "sync/atomic"
     "time"
     "unicode"
     "unicode/utf8"
 
+    "github.com/philipyao/prpc/auth"
     "github.com/philipyao/prpc/codec"
+    "github.com/philipyao/prpc/compress"
     "github.com/philipyao/prpc/message"
     "github.com/philipyao/prpc/registry"
+    "github.com/philipyao/prpc/transport"
     "runtime"
     "bufio"
 )
@@ -24,17 +30,24 @@ const (
     DefaultSrvIndexWeight = 10
     DefaultMsgPack        = codec.SerializeTypeMsgpack
     MaxReadSize           = 65535   //64k
+    HandshakeTimeout      = 10 * time.Second
+
+    DefaultMaxProtocolErrors = 10
+    ProtocolErrorWindow      = time.Minute //协议错误的统计窗口，超过后重新计数
 )
 
 // Precompute the reflect type for error. Can't use error directly
 // because Typeof takes an empty interface value. This is annoying.
 var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
 
 type methodType struct {
     sync.Mutex // protects counters
     method     reflect.Method
     ArgType    reflect.Type
     ReplyType  reflect.Type
+    withCtx    bool // method takes context.Context as first argument
+    acl        ACL  // method level access control
     numCalls   uint
 }
 
@@ -43,13 +56,14 @@ type service struct {
     rcvr   reflect.Value          // receiver of methods for the service
     typ    reflect.Type           // type of the receiver
     method map[string]*methodType // registered methods
+    acl    ACL                    // service level access control
 }
 
 func init() {
     log.SetFlags(log.LstdFlags | log.Lshortfile)
 }
 
-func (s *service) call(server *Server, conn io.ReadWriteCloser, wg *sync.WaitGroup,
+func (s *service) call(server *Server, ctx context.Context, conn io.ReadWriteCloser, wg *sync.WaitGroup,
     mtype *methodType, reqmsg *message.Message, argv, replyv reflect.Value) {
     if wg != nil {
         defer wg.Done()
@@ -59,7 +73,11 @@ func (s *service) call(server *Server, conn io.ReadWriteCloser, wg *sync.WaitGro
     mtype.Unlock()
     function := mtype.method.Func
     // Invoke the method, providing a new value for the reply.
-    returnValues := function.Call([]reflect.Value{s.rcvr, argv, replyv})
+    in := []reflect.Value{s.rcvr, argv, replyv}
+    if mtype.withCtx {
+        in = []reflect.Value{s.rcvr, reflect.ValueOf(ctx), argv, replyv}
+    }
+    returnValues := function.Call(in)
     // The return value for the method is an error.
     errInter := returnValues[0].Interface()
     errmsg := ""
@@ -87,20 +105,35 @@ func isExportedOrBuiltinType(t reflect.Type) bool {
 }
 
 type Server struct {
+    protoErrs uint64 //累计的协议错误数，atomic操作，放在最前保证64位对齐
+
     group string
     index int
 
+    updateLock sync.Mutex //serialize node updates, 修改节点数据和写入注册中心作为一个整体
+    optLock    sync.Mutex //protect weight, version, disabled, registry, listener
     weight     int
     version    string
+    disabled   bool
+    labels     map[string]string
     styp       codec.SerializeType
     serializer codec.Serializer
+    tlsConfig  *tls.Config //非nil时只接受TLS连接
+
+    compressThreshold int //返回包的压缩阈值，小于0不压缩
+
+    limit        message.Limit //读包限制
+    maxProtoErrs int           //单个连接允许的协议错误数，超过后断开
+
+    authenticator auth.Authenticator //非nil时连接需要先认证
 
     serviceMap map[string]*service
+    health     *healthService //内置健康检查服务
 
     //registry
-    registry *registry.Registry
+    registry nodeRegistry
 
-    listener *net.TCPListener
+    listener net.Listener
 
     done chan struct{}
     wg sync.WaitGroup
@@ -115,6 +148,9 @@ func New(group string, index int, opts ...FnOptionServer) *Server {
         version:    registry.DefaultVersion,
         serviceMap: make(map[string]*service),
         done:       make(chan struct{}),
+
+        limit:        message.DefaultLimit,
+        maxProtoErrs: DefaultMaxProtocolErrors,
     }
     for _, opt := range opts {
         err := opt(srv)
@@ -128,82 +164,233 @@ func New(group string, index int, opts ...FnOptionServer) *Server {
         log.Printf("[prpc] err: unsupported styp %v", srv.styp)
         return nil
     }
+    srv.health = newHealthService(srv)
+    err := srv.handle(srv.health, HealthServiceName)
+    if err != nil {
+        log.Printf("[prpc] err: handle health service: %v", err)
+        return nil
+    }
     return srv
 }
 
 //注册rpc处理
-func (s *Server) Handle(rcvr interface{}, name string) error {
-    return s.handle(rcvr, name)
+//注册服务，可通过 WithACL、WithMethodACL 限制调用方
+func (s *Server) Handle(rcvr interface{}, name string, opts ...FnOptionHandle) error {
+    return s.handle(rcvr, name, opts...)
 }
 
+//在addr上监听并提供服务，regConfig为nil时不注册到服务中心(standalone模式)
 func (s *Server) Serve(addr string, regConfig interface{}) error {
-    var reg *registry.Registry
+    //addr 可以是 host:port、unix:///path.sock、pipe://name
+    l, err := transport.Listen(addr)
+    if err != nil {
+        return fmt.Errorf("[rpc] err: listen on %v, %v", addr, err)
+    }
+    err = s.ServeListener(l, regConfig)
+    if err != nil {
+        l.Close()
+    }
+    return err
+}
+
+//在已创建好的listener上提供服务，如socket activation、测试用的随机端口等
+//regConfig为nil时不注册到服务中心
+func (s *Server) ServeListener(l net.Listener, regConfig interface{}) error {
+    if l == nil {
+        return errors.New("[rpc] nil listener")
+    }
+    if s.listener != nil {
+        return errors.New("[rpc] server already serving")
+    }
+    var reg nodeRegistry
     switch regConfig.(type) {
+    case nil:
     case *registry.RegConfigZooKeeper:
-        reg = registry.New(regConfig.(*registry.RegConfigZooKeeper).ZKAddr)
+        zk := registry.New(regConfig.(*registry.RegConfigZooKeeper).ZKAddr)
+        if zk == nil {
+            return errors.New("[registry] invalid registry provided")
+        }
+        reg = zk
     default:
-    }
-
-    if reg == nil {
         return errors.New("[registry] invalid registry provided")
     }
-    s.registry = reg
+    return s.serveRegistry(l, reg)
+}
 
-    laddr, err := net.ResolveTCPAddr("tcp", addr)
-    if err != nil {
-        return fmt.Errorf("[rpc] ResolveTCPAddr(): %v", err)
-    }
+//注册中心中服务端用到的部分
+type nodeRegistry interface {
+    Register(service, group string, index int, addr string, opts ...registry.FnOptionNode) error
+    Update(service, group string, index int, addr string, opts ...registry.FnOptionNode) error
+    Unregister(service, group string, index int) error
+    Close()
+}
 
-    l, err := net.ListenTCP("tcp", laddr)
-    if err != nil {
-        return fmt.Errorf("[rpc] err: listen on %v, %v", laddr, err)
+//注册到reg并开始服务，reg为nil时为standalone模式
+func (s *Server) serveRegistry(l net.Listener, reg nodeRegistry) error {
+    if s.tlsConfig != nil {
+        l = tls.NewListener(l, s.tlsConfig)
     }
-    s.listener = l
 
     log.Println("[rpc] >> rpc service start to serve")
     log.Printf("[rpc] >> [args] group: <%v>", s.group)
     log.Printf("[rpc] >> [args] index: <%v>", s.index)
-    log.Printf("[rpc] >> [args] addr:  <%v>", s.listener.Addr().String())
+    addr := transport.AddrString(l.Addr())
+    log.Printf("[rpc] >> [args] addr:  <%v>", addr)
+    if reg == nil {
+        log.Println("[rpc] >> standalone mode, no registry")
+    }
+    //注册期间的节点数据修改等注册完成后再写入
+    s.updateLock.Lock()
+    defer s.updateLock.Unlock()
     for sname := range s.serviceMap {
+        if reg == nil || sname == HealthServiceName {
+            continue
+        }
         err := reg.Register(
             sname,
             s.group,
             s.index,
-            s.listener.Addr().String(),
-            registry.WithWeight(s.weight),
-            registry.WithVersion(s.version),
-            registry.WithSerialize(s.styp),
+            addr,
+            s.nodeOptions()...,
         )
         if err != nil {
+            reg.Close()
             return fmt.Errorf("register %v err %v", sname, err)
         }
     }
+    s.optLock.Lock()
+    s.registry = reg
+    s.listener = l
+    s.optLock.Unlock()
+
     s.wg.Add(1)
-    go s.doServe()
+    go s.doServe(l)
 
     return nil
 }
 
+//监听地址，未开始服务时返回nil
+func (s *Server) Addr() net.Addr {
+    s.optLock.Lock()
+    defer s.optLock.Unlock()
+    if s.listener == nil {
+        return nil
+    }
+    return s.listener.Addr()
+}
+
+//在线修改权重，客户端通过注册中心感知
+func (s *Server) SetWeight(weight int) error {
+    if registry.WithWeight(weight) == nil {
+        return fmt.Errorf("[rpc] invalid weight %v", weight)
+    }
+    s.updateLock.Lock()
+    defer s.updateLock.Unlock()
+    s.optLock.Lock()
+    s.weight = weight
+    s.optLock.Unlock()
+    return s.updateNodes()
+}
+
+//在线修改版本，用于灰度
+func (s *Server) SetVersion(version string) error {
+    if version == "" {
+        return errors.New("[rpc] empty version not allowed")
+    }
+    s.updateLock.Lock()
+    defer s.updateLock.Unlock()
+    s.optLock.Lock()
+    s.version = version
+    s.optLock.Unlock()
+    return s.updateNodes()
+}
+
+//禁用后客户端不再选取本节点，用于不停服摘流量
+func (s *Server) SetDisabled(disabled bool) error {
+    s.updateLock.Lock()
+    defer s.updateLock.Unlock()
+    s.optLock.Lock()
+    s.disabled = disabled
+    s.optLock.Unlock()
+    return s.updateNodes()
+}
+
 func (s *Server) Fini() {
     log.Println("[rpc] try to stop service.")
     close(s.done)
+    s.optLock.Lock()
+    reg, l := s.registry, s.listener
+    s.optLock.Unlock()
+    if l != nil {
+        //关闭listener以中断Accept
+        l.Close()
+    }
     s.wg.Wait()
 
     log.Println("[rpc] finilize service...")
+    if reg == nil {
+        return
+    }
     for sname := range s.serviceMap {
+        if sname == HealthServiceName {
+            continue
+        }
         //注销服务
         log.Printf("[rpc] unregister service %v: %v.%v\n", sname, s.group, s.index)
-        err := s.registry.Unregister(sname, s.group, s.index)
+        err := reg.Unregister(sname, s.group, s.index)
         if err != nil {
             log.Printf("[rpc][error] unregister err: %v\n", err)
         }
     }
-    s.registry.Close()
+    reg.Close()
 }
 
 //========================================================================
 
-func (server *Server) handle(rcvr interface{}, name string) error {
+func (s *Server) nodeOptions() []registry.FnOptionNode {
+    s.optLock.Lock()
+    defer s.optLock.Unlock()
+    return []registry.FnOptionNode{
+        registry.WithWeight(s.weight),
+        registry.WithVersion(s.version),
+        registry.WithSerialize(s.styp),
+        registry.WithDisabled(s.disabled),
+        registry.WithLabels(s.labels),
+        registry.WithTLS(s.tlsConfig != nil),
+        registry.WithCompress(compress.Supported()),
+        registry.WithFrame(message.FrameVersion),
+    }
+}
+
+//重写所有已注册服务的节点数据，调用方持有updateLock
+func (s *Server) updateNodes() error {
+    s.optLock.Lock()
+    reg, l := s.registry, s.listener
+    s.optLock.Unlock()
+    if reg == nil || l == nil {
+        //尚未开始服务，注册时生效；standalone模式无需更新
+        return nil
+    }
+    opts := s.nodeOptions()
+    for sname := range s.serviceMap {
+        if sname == HealthServiceName {
+            continue
+        }
+        err := reg.Update(
+            sname,
+            s.group,
+            s.index,
+            transport.AddrString(l.Addr()),
+            opts...,
+        )
+        if err != nil {
+            return fmt.Errorf("update %v err %v", sname, err)
+        }
+    }
+    return nil
+}
+
+func (server *Server) handle(rcvr interface{}, name string, opts ...FnOptionHandle) error {
     s := new(service)
     s.typ = reflect.TypeOf(rcvr)
     s.rcvr = reflect.ValueOf(rcvr)
@@ -237,6 +424,29 @@ func (server *Server) handle(rcvr interface{}, name string) error {
         return errors.New(str)
     }
 
+    //检查参数类型能否被序列化，如protobuf只支持proto.Message；
+    //健康检查由客户端以messagepack调用，不受服务端序列化方式限制
+    if checker, ok := server.serializer.(codec.TypeChecker); ok && sname != HealthServiceName {
+        for mname, mtype := range s.method {
+            for _, t := range []reflect.Type{mtype.ArgType, mtype.ReplyType} {
+                if err := checker.CheckType(t); err != nil {
+                    str := fmt.Sprintf("[rpc][error] rpc.Register: method %v.%v: %v", sname, mname, err)
+                    log.Print(str)
+                    return errors.New(str)
+                }
+            }
+        }
+    }
+
+    for n, opt := range opts {
+        if opt == nil {
+            return fmt.Errorf("[rpc][error] decorate service %v, nil option no.%v", sname, n+1)
+        }
+        if err := opt(s); err != nil {
+            return err
+        }
+    }
+
     if _, dup := server.serviceMap[sname]; dup {
         return errors.New("[rpc][error] rpc: service already defined: " + sname)
     }
@@ -245,32 +455,31 @@ func (server *Server) handle(rcvr interface{}, name string) error {
     return nil
 }
 
-func (s *Server) doServe() {
+func (s *Server) doServe(l net.Listener) {
     defer s.wg.Done()
-    defer s.listener.Close()
+    defer l.Close()
 
     for {
-        select {
-        case <-s.done:
-            log.Printf("[rpc] stop listening on %v...", s.listener.Addr())
-            return
-        default:
-        }
-        s.listener.SetDeadline(time.Now().Add(time.Second))
-        conn, err := s.listener.AcceptTCP()
+        conn, err := l.Accept()
         if err != nil {
-            if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+            select {
+            case <-s.done:
+                log.Printf("[rpc] stop listening on %v...", l.Addr())
+                return
+            default:
+            }
+            if ne, ok := err.(net.Error); ok && ne.Timeout() {
                 continue
             }
             log.Printf("[rpc][error] accept connection, %v", err.Error())
-            break
+            return
         }
         log.Printf("[rpc] accept new connection: %p", conn)
         go s.serveConn(conn)
     }
 }
 
-func (s *Server) serveConn(conn io.ReadWriteCloser) {
+func (s *Server) serveConn(conn net.Conn) {
     defer func() {
         if err := recover(); err != nil {
             const size = 64 << 10
@@ -284,39 +493,173 @@ func (s *Server) serveConn(conn io.ReadWriteCloser) {
         }
     }()
 
+    if tc, ok := conn.(*tls.Conn); ok {
+        tc.SetDeadline(time.Now().Add(HandshakeTimeout))
+        if err := tc.Handshake(); err != nil {
+            log.Printf("[rpc][error] tls handshake with %v: %v", conn.RemoteAddr(), err)
+            conn.Close()
+            return
+        }
+        tc.SetDeadline(time.Time{})
+    }
+    peer := newPeer(conn)
     wg := new(sync.WaitGroup)
     reader := bufio.NewReaderSize(conn, MaxReadSize)
+    if s.authenticator != nil {
+        conn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+        principal, err := s.authenticate(conn, reader, peer)
+        if err != nil {
+            log.Printf("[rpc][error] authenticate %v: %v", conn.RemoteAddr(), err)
+            conn.Close()
+            return
+        }
+        conn.SetReadDeadline(time.Time{})
+        peer.Principal = principal
+    }
+    ctx := newPeerContext(context.Background(), peer)
+
+    var protoErrs protocolErrors //连接上的协议错误数
     for {
-        reqmsg, err := message.NewResponse(reader)
+        reqmsg, err := message.NewResponseLimit(reader, s.limit)
+        if _, ok := err.(*message.BodyError); ok {
+            //包已完整读出，返回错误后继续处理后续的包
+            log.Printf("[rpc][error] conn %p: %v", conn, err)
+            s.sendError(conn, reqmsg, message.ErrCodeServer, err.Error())
+            if !s.protocolError(conn, &protoErrs) {
+                break
+            }
+            continue
+        }
         if err != nil {
-            if err != io.EOF {
+            switch err {
+            case io.EOF:
+            case message.ErrMagic, message.ErrVersion, message.ErrInvLength:
+                //包头非法时无法定位下一个包，直接断开
+                atomic.AddUint64(&s.protoErrs, 1)
+                log.Printf("[rpc][error] conn %p bad frame: %v", conn, err)
+            default:
                 log.Printf("[rpc] err: NewResponse %v", err)
             }
             break
         }
 
+        if reqmsg.IsHeartbeat() {
+            //todo 处理rpc心跳
+            reqmsg.Release()
+            continue
+        }
+        if reqmsg.ServiceMethod() == auth.HandshakeMethod {
+            //未开启认证或已认证过，直接通过
+            reqmsg.Release()
+            s.sendHandshakeReply(conn, reqmsg, nil)
+            continue
+        }
         service, mtype, argv, replyv, err := s.unpackRequest(reqmsg)
+        //参数已解出，归还读缓冲
+        reqmsg.Release()
         if err != nil {
             //if err != io.EOF {
                 log.Printf("[rpc][error] unpackRequest: %v", err)
             //}
+            //找不到服务/方法、参数解码失败不算协议错误，如滚动升级时调用尚未部署的方法
+            s.sendError(conn, reqmsg, message.ErrCodeServer, err.Error())
+            continue
+        }
+        if !service.allow(ctx, mtype) {
+            log.Printf("[rpc][error] conn %p permission denied: %v", conn, reqmsg.ServiceMethod())
+            s.sendError(conn, reqmsg, message.ErrCodePermissionDenied, "permission denied: "+reqmsg.ServiceMethod())
             continue
         }
-        log.Printf("conn %p receive msg %v", conn, mtype)
+        log.Printf("conn %p receive msg %v", conn, mtype.method.Name)
         wg.Add(1)
-        go service.call(s, conn, wg, mtype, reqmsg, argv, replyv)
+        go service.call(s, ctx, conn, wg, mtype, reqmsg, argv, replyv)
     }
     // We've seen that there are no more requests.
     // Wait for responses to be sent before closing codec.
     wg.Wait()
-    log.Printf("[rpc] conn %v end", conn)
+    log.Printf("[rpc] conn %p end", conn)
     conn.Close()
 }
 
+//连接上的协议错误计数，超过统计窗口后重新计数
+type protocolErrors struct {
+    count int
+    since time.Time
+}
+
+//记录连接上的非法包，窗口内超过上限时返回false，断开连接
+func (s *Server) protocolError(conn net.Conn, errs *protocolErrors) bool {
+    atomic.AddUint64(&s.protoErrs, 1)
+    now := time.Now()
+    if now.Sub(errs.since) > ProtocolErrorWindow {
+        errs.count, errs.since = 0, now
+    }
+    errs.count++
+    if errs.count > s.maxProtoErrs {
+        log.Printf("[rpc][error] conn %p too many protocol errors, closing", conn)
+        return false
+    }
+    return true
+}
+
+//累计的协议错误数，用于监控
+func (s *Server) ProtocolErrors() uint64 {
+    return atomic.LoadUint64(&s.protoErrs)
+}
+
+//连接的第一个包必须是认证请求
+func (s *Server) authenticate(conn net.Conn, reader io.Reader, peer *Peer) (*auth.Principal, error) {
+    reqmsg, err := message.NewResponseLimit(reader, s.limit)
+    if err != nil {
+        return nil, err
+    }
+    if reqmsg.ServiceMethod() != auth.HandshakeMethod {
+        return nil, errors.New("handshake required")
+    }
+    creds := new(auth.Credentials)
+    serializer, err := s.serializerOf(reqmsg)
+    if err == nil {
+        err = reqmsg.Unpack(serializer, creds)
+    }
+    reqmsg.Release()
+    if err != nil {
+        err = fmt.Errorf("%v: %v", auth.ErrInvalidCredentials, err)
+        s.sendHandshakeReply(conn, reqmsg, err)
+        return nil, err
+    }
+    principal, err := s.authenticator(newPeerContext(context.Background(), peer), creds)
+    if err == nil && principal == nil {
+        err = errors.New("no principal authenticated")
+    }
+    s.sendHandshakeReply(conn, reqmsg, err)
+    if err != nil {
+        return nil, err
+    }
+    log.Printf("[rpc] conn %p authenticated as %v", conn, principal.Name)
+    return principal, nil
+}
+
+//认证结果，空字符串表示通过
+func (s *Server) sendHandshakeReply(conn io.Writer, reqmsg *message.Message, err error) {
+    errmsg := ""
+    if err != nil {
+        errmsg = err.Error()
+    }
+    serializer, err := s.serializerOf(reqmsg)
+    if err != nil {
+        log.Printf("[rpc] handshake reply: %v", err)
+        return
+    }
+    err = s.newReply(reqmsg).PackTo(conn, auth.HandshakeMethod, errmsg, serializer)
+    if err != nil {
+        log.Printf("[rpc] pack error: %v", err)
+    }
+}
+
 func (s *Server) unpackRequest(msg *message.Message) (service *service, mtype *methodType, argv, replyv reflect.Value, err error) {
     if msg.IsHeartbeat() {
-        //todo
-        panic("heartbeat")
+        err = message.ErrUnpackHeartbeat
+        return
     }
     serviceMethod := msg.ServiceMethod()
     dot := strings.LastIndex(serviceMethod, ".")
@@ -348,7 +691,11 @@ func (s *Server) unpackRequest(msg *message.Message) (service *service, mtype *m
         argIsValue = true
     }
     // argv guaranteed to be a pointer now.
-    err = msg.Unpack(s.serializer, argv.Interface())
+    serializer, err := s.serializerOf(msg)
+    if err != nil {
+        return
+    }
+    err = msg.Unpack(serializer, argv.Interface())
     if err != nil {
         log.Printf("[rpc][error] Unpack: %v", err)
         return
@@ -369,23 +716,33 @@ func (s *Server) unpackRequest(msg *message.Message) (service *service, mtype *m
 }
 
 func (s *Server) sendResponse(conn io.ReadWriteCloser, reqmsg *message.Message, reply interface{}, errmsg string) {
-    log.Printf("[rpc] sendResponse: conn %v, reply %+v, seqno %v, method %v",
+    log.Printf("[rpc] sendResponse: conn %p, reply %+v, seqno %v, method %v",
         conn, reply, reqmsg.Seqno(), reqmsg.ServiceMethod())
-    pkg := message.NewRequest(message.MsgKindDefault, reqmsg.Seqno())
-    // Encode the response header
     if errmsg != "" {
-        //todo
-        panic("errmsg")
-        reply = struct{}{}
+        s.sendError(conn, reqmsg, message.ErrCodeServer, errmsg)
+        return
     }
-    data, err := pkg.Pack(reqmsg.ServiceMethod(), reply, s.serializer)
+    //使用调用方的序列化方式返回
+    serializer, err := s.serializerOf(reqmsg)
     if err != nil {
-        //todo
-        log.Printf("[rpc] pack error: %v", err)
+        s.sendError(conn, reqmsg, message.ErrCodeServer, err.Error())
         return
     }
     //todo write timeout
-    conn.Write(data)
+    err = s.newReply(reqmsg).PackTo(conn, reqmsg.ServiceMethod(), reply, serializer)
+    if err != nil {
+        log.Printf("[rpc] pack error: %v", err)
+        s.sendError(conn, reqmsg, message.ErrCodeServer, "pack reply: "+err.Error())
+        return
+    }
+}
+
+//返回错误，客户端据此生成对应类型的error
+func (s *Server) sendError(conn io.Writer, reqmsg *message.Message, code message.ErrCode, errmsg string) {
+    err := s.newReply(reqmsg).PackErrorTo(conn, reqmsg.ServiceMethod(), code, errmsg)
+    if err != nil {
+        log.Printf("[rpc] pack error: %v", err)
+    }
 }
 
 // suitableMethods returns suitable Rpc methods of typ
@@ -399,19 +756,24 @@ func suitableMethods(typ reflect.Type) map[string]*methodType {
         if method.PkgPath != "" {
             continue
         }
-        // Method needs three ins: receiver, *args, *reply.
-        if mtype.NumIn() != 3 {
+        // Method needs three ins: receiver, *args, *reply,
+        // or four with context.Context as the first argument.
+        ofs := 1
+        if mtype.NumIn() == 4 && mtype.In(1) == typeOfContext {
+            ofs = 2
+        }
+        if mtype.NumIn() != ofs+2 {
             log.Printf("rpc.Register: method %q has %d input parameters; needs exactly three\n", mname, mtype.NumIn())
             continue
         }
         // First arg need not be a pointer.
-        argType := mtype.In(1)
+        argType := mtype.In(ofs)
         if !isExportedOrBuiltinType(argType) {
             log.Printf("rpc.Register: argument type of method %q is not exported: %q\n", mname, argType)
             continue
         }
         // Second arg must be a pointer.
-        replyType := mtype.In(2)
+        replyType := mtype.In(ofs + 1)
         if replyType.Kind() != reflect.Ptr {
             log.Printf("rpc.Register: reply type of method %q is not a pointer: %q\n", mname, replyType)
             continue
@@ -431,7 +793,36 @@ func suitableMethods(typ reflect.Type) map[string]*methodType {
             log.Printf("rpc.Register: return type of method %q is %q, must be error\n", mname, returnType)
             continue
         }
-        methods[mname] = &methodType{method: method, ArgType: argType, ReplyType: replyType}
+        methods[mname] = &methodType{method: method, ArgType: argType, ReplyType: replyType, withCtx: ofs == 2}
     }
     return methods
 }
+
+//请求payload的序列化方式，旧版本的请求没有携带，使用服务端的序列化方式
+func (s *Server) serializerOf(reqmsg *message.Message) (codec.Serializer, error) {
+    styp := reqmsg.SerializeType()
+    if styp == codec.SerializeTypeNone {
+        return s.serializer, nil
+    }
+    serializer := codec.GetSerializer(styp)
+    if serializer == nil {
+        return nil, fmt.Errorf("[rpc] unsupported serialize type %v", styp)
+    }
+    return serializer, nil
+}
+
+//返回包与请求的版本、序列化方式一致，按调用方指定的方式压缩，
+//未指定或本端不支持时使用gzip
+func (s *Server) newReply(reqmsg *message.Message) *message.Message {
+    pkg := message.NewRequest(message.MsgKindDefault, reqmsg.Seqno())
+    pkg.SetSerializeType(reqmsg.SerializeType())
+    ck := reqmsg.AcceptCompress()
+    if ck == message.CompressKindNone || compress.Get(ck) == nil {
+        ck = message.CompressKindGzip
+    }
+    if s.compressThreshold < 0 {
+        ck = message.CompressKindNone
+    }
+    pkg.SetCompress(ck, s.compressThreshold)
+    return pkg
+}
@@ -1,7 +1,10 @@
 package server
 
 import (
+    "crypto/tls"
+    "github.com/philipyao/prpc/auth"
     "github.com/philipyao/prpc/codec"
+    "github.com/philipyao/prpc/message"
     "log"
 )
 
@@ -35,3 +38,88 @@ func WithVersion(version string) FnOptionServer {
     }
 }
 
+func WithLabels(labels map[string]string) FnOptionServer {
+    for k := range labels {
+        if k == "" {
+            log.Println("empty label key not allowed")
+            return nil
+        }
+    }
+    return func(srv *Server) error {
+        srv.labels = make(map[string]string, len(labels))
+        for k, v := range labels {
+            srv.labels[k] = v
+        }
+        return nil
+    }
+}
+
+func WithTLSConfig(config *tls.Config) FnOptionServer {
+    //只接受TLS连接，注册到服务中心的节点标记为TLS，客户端自动使用TLS连接；
+    //双向认证设置 ClientAuth: tls.RequireAndVerifyClientCert 和 ClientCAs
+    if config == nil || (len(config.Certificates) == 0 &&
+        config.GetCertificate == nil && config.GetConfigForClient == nil) {
+        log.Println("invalid tls config, no certificate provided")
+        return nil
+    }
+    return func(srv *Server) error {
+        srv.tlsConfig = config
+        return nil
+    }
+}
+
+func WithCompressThreshold(threshold int) FnOptionServer {
+    //返回包超过threshold字节时压缩，压缩方式由调用方指定；0使用默认阈值，小于0不压缩
+    return func(srv *Server) error {
+        srv.compressThreshold = threshold
+        return nil
+    }
+}
+
+func WithMaxDecompressLen(n int) FnOptionServer {
+    //请求解压后的最大长度，防止压缩炸弹
+    if n <= 0 {
+        log.Println("invalid max decompress length")
+        return nil
+    }
+    return func(srv *Server) error {
+        srv.limit.MaxDecompressLen = n
+        return nil
+    }
+}
+
+func WithMaxMethodLen(n int) FnOptionServer {
+    if n <= 0 || n > message.MaxMethodLen {
+        log.Println("invalid max method length")
+        return nil
+    }
+    return func(srv *Server) error {
+        srv.limit.MaxMethodLen = n
+        return nil
+    }
+}
+
+func WithMaxProtocolErrors(n int) FnOptionServer {
+    //单个连接上ProtocolErrorWindow内非法的包超过n个时断开连接，包头非法时直接断开；
+    //找不到服务/方法不算非法的包
+    if n <= 0 {
+        log.Println("invalid max protocol errors")
+        return nil
+    }
+    return func(srv *Server) error {
+        srv.maxProtoErrs = n
+        return nil
+    }
+}
+
+func WithAuthenticator(fn auth.Authenticator) FnOptionServer {
+    //连接建立后先认证客户端发送的凭证，失败则断开连接
+    if fn == nil {
+        log.Println("nil authenticator")
+        return nil
+    }
+    return func(srv *Server) error {
+        srv.authenticator = fn
+        return nil
+    }
+}
@@ -1 +1,918 @@
 package server
+
+import (
+    "bytes"
+    "context"
+    "encoding/gob"
+    "errors"
+    "io"
+    "io/ioutil"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/golang/protobuf/ptypes/wrappers"
+    "github.com/philipyao/prpc/auth"
+    "github.com/philipyao/prpc/client"
+    "github.com/philipyao/prpc/codec"
+    "github.com/philipyao/prpc/compress"
+    "github.com/philipyao/prpc/message"
+    "github.com/philipyao/prpc/registry"
+    "github.com/philipyao/prpc/transport"
+)
+
+type Arith int
+
+type Args struct {
+    A, B int
+}
+
+func (t *Arith) Multiply(args *Args, reply *int) error {
+    *reply = args.A * args.B
+    return nil
+}
+
+func TestHealthCheck(t *testing.T) {
+    srv := New("zone1001", 1)
+    if srv == nil {
+        t.Fatal("new server error")
+    }
+    if err := srv.Handle(new(Arith), "Arith"); err != nil {
+        t.Fatal(err)
+    }
+    mtype := srv.serviceMap[HealthServiceName].method["Check"]
+    if mtype == nil {
+        t.Fatal("health service not handled")
+    }
+
+    check := func(service string, expect HealthStatus) {
+        var status HealthStatus
+        if err := srv.health.Check(service, &status); err != nil {
+            t.Fatal(err)
+        }
+        if status != expect {
+            t.Fatalf("service %q status %v, expect %v", service, status, expect)
+        }
+    }
+    check("", HealthServing)
+    check("Arith", HealthServing)
+    check("Unknown", HealthServiceUnknown)
+    check(HealthServiceName, HealthServiceUnknown)
+
+    if err := srv.SetServingStatus("Arith", HealthNotServing); err != nil {
+        t.Fatal(err)
+    }
+    check("Arith", HealthNotServing)
+    check("", HealthServing)
+    if err := srv.SetServingStatus("Arith", HealthServing); err != nil {
+        t.Fatal(err)
+    }
+
+    //整个server维护中
+    if err := srv.SetServingStatus("", HealthNotServing); err != nil {
+        t.Fatal(err)
+    }
+    check("", HealthNotServing)
+    check("Arith", HealthNotServing)
+
+    if err := srv.SetServingStatus("Unknown", HealthNotServing); err == nil {
+        t.Fatal("set status of unknown service")
+    }
+    if err := srv.SetServingStatus("Arith", HealthServiceUnknown); err == nil {
+        t.Fatal("set invalid status")
+    }
+}
+
+func TestServeStandalone(t *testing.T) {
+    srv := New("zone1001", 1)
+    if err := srv.Handle(new(Arith), "Arith"); err != nil {
+        t.Fatal(err)
+    }
+    if srv.Addr() != nil {
+        t.Fatal("addr available before serving")
+    }
+    if err := srv.Serve("127.0.0.1:0", "invalid"); err == nil {
+        t.Fatal("invalid registry config accepted")
+    }
+
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := srv.ServeListener(l, nil); err != nil {
+        t.Fatal(err)
+    }
+    if srv.Addr().String() != l.Addr().String() {
+        t.Fatalf("unexpected addr %v, expect %v", srv.Addr(), l.Addr())
+    }
+    if err := srv.ServeListener(l, nil); err == nil {
+        t.Fatal("serve twice")
+    }
+    //standalone模式下在线修改节点数据不报错
+    if err := srv.SetWeight(20); err != nil {
+        t.Fatal(err)
+    }
+
+    cli, err := client.Dial(l.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer cli.Close()
+    var reply int
+    err = cli.Call(context.Background(), "Arith.Multiply", &Args{A: 7, B: 8}, &reply)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if reply != 56 {
+        t.Fatalf("unexpected reply %v", reply)
+    }
+
+    done := make(chan struct{})
+    go func() {
+        srv.Fini()
+        close(done)
+    }()
+    select {
+    case <-done:
+    case <-time.After(3 * time.Second):
+        t.Fatal("fini blocked")
+    }
+    if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+        t.Fatal("listener still open after fini")
+    }
+}
+
+//记录写入的节点数据
+type memRegistry struct {
+    lock   sync.Mutex
+    nodes  map[string]*registry.Node //service -> node
+    closed bool
+}
+
+func newNode(group string, index int, addr string, opts []registry.FnOptionNode) (*registry.Node, error) {
+    node := &registry.Node{
+        ID:         registry.ID{Group: group, Index: index},
+        Addr:       addr,
+        NodeOption: new(registry.NodeOption),
+    }
+    for _, opt := range opts {
+        if opt == nil {
+            return nil, errors.New("nil node option")
+        }
+        if err := opt(node); err != nil {
+            return nil, err
+        }
+    }
+    return node, nil
+}
+
+func (mr *memRegistry) Register(service, group string, index int, addr string, opts ...registry.FnOptionNode) error {
+    mr.lock.Lock()
+    defer mr.lock.Unlock()
+    if _, exist := mr.nodes[service]; exist {
+        return errors.New("node exist")
+    }
+    node, err := newNode(group, index, addr, opts)
+    if err != nil {
+        return err
+    }
+    mr.nodes[service] = node
+    return nil
+}
+func (mr *memRegistry) Update(service, group string, index int, addr string, opts ...registry.FnOptionNode) error {
+    mr.lock.Lock()
+    defer mr.lock.Unlock()
+    if _, exist := mr.nodes[service]; !exist {
+        return errors.New("node not exist")
+    }
+    node, err := newNode(group, index, addr, opts)
+    if err != nil {
+        return err
+    }
+    mr.nodes[service] = node
+    return nil
+}
+func (mr *memRegistry) Unregister(service, group string, index int) error {
+    mr.lock.Lock()
+    defer mr.lock.Unlock()
+    delete(mr.nodes, service)
+    return nil
+}
+func (mr *memRegistry) Close() {
+    mr.lock.Lock()
+    defer mr.lock.Unlock()
+    mr.closed = true
+}
+
+//在线修改节点数据，检查写入注册中心的数据
+func TestUpdateNode(t *testing.T) {
+    reg := &memRegistry{nodes: make(map[string]*registry.Node)}
+    published := func(service string) []*registry.Node {
+        reg.lock.Lock()
+        defer reg.lock.Unlock()
+        if node, ok := reg.nodes[service]; ok {
+            return []*registry.Node{node}
+        }
+        return nil
+    }
+
+    srv := New("zone1001", 1)
+    if err := srv.Handle(new(Arith), "Arith"); err != nil {
+        t.Fatal(err)
+    }
+    if err := srv.Handle(new(Echo), "Echo"); err != nil {
+        t.Fatal(err)
+    }
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err = srv.serveRegistry(l, reg); err != nil {
+        t.Fatal(err)
+    }
+    addr := transport.AddrString(srv.Addr())
+    nodes := published("Arith")
+    if len(nodes) != 1 || nodes[0].Addr != addr || nodes[0].Weight != DefaultSrvIndexWeight ||
+        nodes[0].Version != registry.DefaultVersion || nodes[0].Disabled {
+        t.Fatalf("unexpected registered nodes %+v", nodes)
+    }
+
+    if err := srv.SetWeight(20); err != nil {
+        t.Fatal(err)
+    }
+    if err := srv.SetVersion("v1.1"); err != nil {
+        t.Fatal(err)
+    }
+    if err := srv.SetDisabled(true); err != nil {
+        t.Fatal(err)
+    }
+    if srv.SetWeight(-1) == nil || srv.SetVersion("") == nil {
+        t.Fatal("invalid node data accepted")
+    }
+    for _, service := range []string{"Arith", "Echo"} {
+        nodes = published(service)
+        if len(nodes) != 1 || nodes[0].Addr != addr || nodes[0].Weight != 20 ||
+            nodes[0].Version != "v1.1" || !nodes[0].Disabled {
+            t.Fatalf("unexpected %v nodes %+v", service, nodes)
+        }
+    }
+    if nodes = published(HealthServiceName); len(nodes) != 0 {
+        t.Fatalf("health service registered: %+v", nodes)
+    }
+
+    //并发修改，注册中心的数据与最后一次修改一致
+    var wg sync.WaitGroup
+    for i := 1; i <= 200; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            if i%2 == 0 {
+                srv.SetWeight(i)
+            } else {
+                srv.SetDisabled(i%4 == 1)
+            }
+        }(i)
+    }
+    wg.Wait()
+    srv.optLock.Lock()
+    weight, disabled := srv.weight, srv.disabled
+    srv.optLock.Unlock()
+    for _, service := range []string{"Arith", "Echo"} {
+        nodes = published(service)
+        if len(nodes) != 1 || nodes[0].Weight != weight || nodes[0].Disabled != disabled {
+            t.Fatalf("stale %v nodes %+v, expect weight %v disabled %v", service, nodes, weight, disabled)
+        }
+    }
+
+    srv.Fini()
+    if nodes = published("Arith"); len(nodes) != 0 || !reg.closed {
+        t.Fatalf("nodes left after fini: %+v", nodes)
+    }
+}
+
+func TestServeTransports(t *testing.T) {
+    dir, err := ioutil.TempDir("", "prpc")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    for _, addr := range []string{"unix://" + filepath.Join(dir, "arith.sock"), "pipe://arith"} {
+        srv := New("zone1001", 1)
+        if err := srv.Handle(new(Arith), "Arith"); err != nil {
+            t.Fatal(err)
+        }
+        if err := srv.Serve(addr, nil); err != nil {
+            t.Fatal(err)
+        }
+        if transport.AddrString(srv.Addr()) != addr {
+            t.Fatalf("unexpected addr %v, expect %v", srv.Addr(), addr)
+        }
+        cli, err := client.Dial(addr)
+        if err != nil {
+            t.Fatal(err)
+        }
+        var reply int
+        err = cli.Call(context.Background(), "Arith.Multiply", &Args{A: 3, B: 4}, &reply)
+        if err != nil || reply != 12 {
+            t.Fatalf("call over %v: reply %v, err %v", addr, reply, err)
+        }
+        cli.Close()
+        srv.Fini()
+    }
+}
+
+func BenchmarkCallPipe(b *testing.B) {
+    srv := New("zone1001", 1)
+    srv.Handle(new(Arith), "Arith")
+    if err := srv.Serve("pipe://bench", nil); err != nil {
+        b.Fatal(err)
+    }
+    defer srv.Fini()
+    cli, err := client.Dial("pipe://bench")
+    if err != nil {
+        b.Fatal(err)
+    }
+    defer cli.Close()
+
+    args := &Args{A: 7, B: 8}
+    b.ResetTimer()
+    b.RunParallel(func(pb *testing.PB) {
+        var reply int
+        for pb.Next() {
+            if err := cli.Call(context.Background(), "Arith.Multiply", args, &reply); err != nil {
+                b.Fatal(err)
+            }
+        }
+    })
+}
+
+type Echo int
+
+func (e *Echo) RemoteAddr(ctx context.Context, args int, reply *string) error {
+    peer, ok := PeerFromContext(ctx)
+    if !ok {
+        return errors.New("no peer in context")
+    }
+    if peer.Identity() != "" {
+        return errors.New("identity on plaintext connection")
+    }
+    *reply = peer.Addr.String()
+    return nil
+}
+
+func TestContextMethod(t *testing.T) {
+    srv := New("zone1001", 1)
+    if err := srv.Handle(new(Echo), "Echo"); err != nil {
+        t.Fatal(err)
+    }
+    if mtype := srv.serviceMap["Echo"].method["RemoteAddr"]; mtype == nil || !mtype.withCtx {
+        t.Fatal("method with context not handled")
+    }
+    if err := srv.Serve("127.0.0.1:0", nil); err != nil {
+        t.Fatal(err)
+    }
+    defer srv.Fini()
+
+    cli, err := client.Dial(srv.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer cli.Close()
+    var reply string
+    if err := cli.Call(context.Background(), "Echo.RemoteAddr", 1, &reply); err != nil {
+        t.Fatal(err)
+    }
+    if reply == "" {
+        t.Fatal("empty peer addr")
+    }
+}
+
+type Whoami int
+
+func (w *Whoami) Name(ctx context.Context, args int, reply *string) error {
+    peer, _ := PeerFromContext(ctx)
+    if peer.Principal == nil {
+        return errors.New("not authenticated")
+    }
+    *reply = peer.Principal.Name
+    return nil
+}
+
+func TestAuthenticator(t *testing.T) {
+    secrets := map[string][]byte{"gm": []byte("secret")}
+    verifier := auth.NewHMACVerifier(func(id string) ([]byte, bool) {
+        s, ok := secrets[id]
+        return s, ok
+    }, time.Minute)
+    srv := New("zone1001", 1, WithAuthenticator(func(ctx context.Context, creds *auth.Credentials) (*auth.Principal, error) {
+        if peer, ok := PeerFromContext(ctx); !ok || peer.Addr == nil {
+            return nil, errors.New("no peer")
+        }
+        if creds.Token != "" {
+            if creds.Token != "letmein" {
+                return nil, errors.New("bad token")
+            }
+            return &auth.Principal{Name: creds.ID}, nil
+        }
+        if err := verifier.Verify(creds); err != nil {
+            return nil, err
+        }
+        return &auth.Principal{Name: creds.ID, Roles: []string{"gm"}}, nil
+    }))
+    if srv == nil {
+        t.Fatal("new server with authenticator failed")
+    }
+    if err := srv.Handle(new(Whoami), "Whoami"); err != nil {
+        t.Fatal(err)
+    }
+    if err := srv.Serve("127.0.0.1:0", nil); err != nil {
+        t.Fatal(err)
+    }
+    defer srv.Fini()
+    addr := srv.Addr().String()
+
+    call := func(creds auth.CredentialsProvider) (string, error) {
+        opts := []client.FnOptionDial{client.WithDialTimeout(time.Second)}
+        if creds != nil {
+            opts = append(opts, client.WithDialCredentials(creds))
+        }
+        cli, err := client.Dial(addr, opts...)
+        if err != nil {
+            return "", err
+        }
+        defer cli.Close()
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+        defer cancel()
+        var reply string
+        err = cli.Call(ctx, "Whoami.Name", 1, &reply)
+        return reply, err
+    }
+
+    name, err := call(auth.Token("tool", "letmein"))
+    if err != nil || name != "tool" {
+        t.Fatalf("token auth: name %q, err %v", name, err)
+    }
+    name, err = call(auth.HMAC("gm", []byte("secret")))
+    if err != nil || name != "gm" {
+        t.Fatalf("hmac auth: name %q, err %v", name, err)
+    }
+    _, err = call(auth.Token("tool", "guess"))
+    if err == nil || !strings.Contains(err.Error(), "bad token") {
+        t.Fatalf("bad token accepted: %v", err)
+    }
+    _, err = call(auth.HMAC("gm", []byte("wrong")))
+    if err == nil || !strings.Contains(err.Error(), auth.ErrBadSignature.Error()) {
+        t.Fatalf("bad signature accepted: %v", err)
+    }
+    if _, err = call(nil); err == nil {
+        t.Fatal("call without credentials succeeded")
+    }
+}
+
+type Admin int
+
+func (a *Admin) Kick(args string, reply *bool) error {
+    if args == "" {
+        return errors.New("empty player")
+    }
+    *reply = true
+    return nil
+}
+
+func (a *Admin) Status(args int, reply *string) error {
+    *reply = "ok"
+    return nil
+}
+
+func TestACL(t *testing.T) {
+    srv := New("zone1001", 1, WithAuthenticator(func(ctx context.Context, creds *auth.Credentials) (*auth.Principal, error) {
+        p := &auth.Principal{Name: creds.ID}
+        if creds.Token == "gm" {
+            p.Roles = []string{"gm"}
+        }
+        return p, nil
+    }))
+    err := srv.Handle(new(Admin), "Admin", WithMethodACL("Unknown", AllowRoles("gm")))
+    if err == nil {
+        t.Fatal("acl for unknown method accepted")
+    }
+    err = srv.Handle(new(Admin), "Admin",
+        WithACL(AllowRoles("gm")),
+        WithMethodACL("Status", AllowNames("monitor")),
+    )
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := srv.Handle(new(Arith), "Arith"); err != nil {
+        t.Fatal(err)
+    }
+    if err := srv.Serve("127.0.0.1:0", nil); err != nil {
+        t.Fatal(err)
+    }
+    defer srv.Fini()
+
+    dial := func(id, token string) *client.RPCClient {
+        cli, err := client.Dial(srv.Addr().String(), client.WithDialCredentials(auth.Token(id, token)))
+        if err != nil {
+            t.Fatal(err)
+        }
+        return cli
+    }
+    call := func(cli *client.RPCClient, method string, args, reply interface{}) error {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+        defer cancel()
+        return cli.Call(ctx, method, args, reply)
+    }
+
+    gm, player, monitor := dial("gm1", "gm"), dial("player1", ""), dial("monitor", "")
+    defer gm.Close()
+    defer player.Close()
+    defer monitor.Close()
+
+    var kicked bool
+    if err := call(gm, "Admin.Kick", "player1", &kicked); err != nil || !kicked {
+        t.Fatalf("gm kick: %v %v", kicked, err)
+    }
+    err = call(player, "Admin.Kick", "gm1", &kicked)
+    if !client.IsPermissionDenied(err) {
+        t.Fatalf("player kick: %v", err)
+    }
+    //handler返回的错误
+    err = call(gm, "Admin.Kick", "", &kicked)
+    if _, ok := err.(client.ServerError); !ok || err.Error() != "empty player" {
+        t.Fatalf("unexpected error %#v", err)
+    }
+
+    //方法级ACL优先
+    var status string
+    if err := call(monitor, "Admin.Status", 1, &status); err != nil || status != "ok" {
+        t.Fatalf("monitor status: %v %v", status, err)
+    }
+    if err := call(gm, "Admin.Status", 1, &status); !client.IsPermissionDenied(err) {
+        t.Fatalf("gm status: %v", err)
+    }
+
+    //没有ACL的service不受限制，拒绝后连接仍可用
+    var product int
+    if err := call(player, "Arith.Multiply", &Args{A: 2, B: 3}, &product); err != nil || product != 6 {
+        t.Fatalf("player multiply: %v %v", product, err)
+    }
+    //不存在的方法
+    if _, ok := call(player, "Arith.Divide", &Args{}, &product).(client.ServerError); !ok {
+        t.Fatal("call unknown method should return server error")
+    }
+}
+
+type Greeter int
+
+func (g *Greeter) Hello(args *wrappers.StringValue, reply *wrappers.StringValue) error {
+    reply.Value = "hello " + args.Value
+    return nil
+}
+
+func TestProtobufServer(t *testing.T) {
+    srv := New("zone1001", 1, WithSerialize(codec.SerializeTypeProtobuf))
+    if srv == nil {
+        t.Fatal("new protobuf server failed")
+    }
+    //参数不是proto.Message
+    err := srv.Handle(new(Arith), "Arith")
+    if err == nil || !strings.Contains(err.Error(), "Multiply") {
+        t.Fatalf("non proto service handled: %v", err)
+    }
+    if err := srv.Handle(new(Greeter), "Greeter"); err != nil {
+        t.Fatal(err)
+    }
+    if err := srv.Serve("127.0.0.1:0", nil); err != nil {
+        t.Fatal(err)
+    }
+    defer srv.Fini()
+
+    cli, err := client.Dial(srv.Addr().String(), client.WithDialSerialize(codec.SerializeTypeProtobuf))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer cli.Close()
+    var reply wrappers.StringValue
+    err = cli.Call(context.Background(), "Greeter.Hello", &wrappers.StringValue{Value: "world"}, &reply)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if reply.Value != "hello world" {
+        t.Fatalf("unexpected reply %q", reply.Value)
+    }
+    if err := cli.Call(context.Background(), "Greeter.Hello", "world", &reply); err == nil {
+        t.Fatal("non proto args sent")
+    }
+}
+
+const serializeTypeGob codec.SerializeType = 100
+
+type gobSerializer struct{}
+
+func (gs gobSerializer) Encode(v interface{}) ([]byte, error) {
+    var buf bytes.Buffer
+    err := gob.NewEncoder(&buf).Encode(v)
+    return buf.Bytes(), err
+}
+func (gs gobSerializer) Decode(data []byte, v interface{}) error {
+    return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func init() {
+    if err := codec.Register(serializeTypeGob, "gob", gobSerializer{}); err != nil {
+        panic(err)
+    }
+}
+
+func TestCustomCodec(t *testing.T) {
+    if New("zone1001", 1, WithSerialize(101)) != nil {
+        t.Fatal("server with unregistered codec created")
+    }
+    styp, ok := codec.Lookup("gob")
+    if !ok {
+        t.Fatal("gob codec not found")
+    }
+    srv := New("zone1001", 1, WithSerialize(styp))
+    if srv == nil {
+        t.Fatal("new server with custom codec failed")
+    }
+    if err := srv.Handle(new(Arith), "Arith"); err != nil {
+        t.Fatal(err)
+    }
+    if err := srv.Serve("127.0.0.1:0", nil); err != nil {
+        t.Fatal(err)
+    }
+    defer srv.Fini()
+
+    cli, err := client.Dial(srv.Addr().String(), client.WithDialSerialize(styp))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer cli.Close()
+    var reply int
+    err = cli.Call(context.Background(), "Arith.Multiply", &Args{A: 6, B: 7}, &reply)
+    if err != nil || reply != 42 {
+        t.Fatalf("call with gob codec: %v %v", reply, err)
+    }
+}
+
+func TestPerCallSerialize(t *testing.T) {
+    srv := New("zone1001", 1)
+    if err := srv.Handle(new(Arith), "Arith"); err != nil {
+        t.Fatal(err)
+    }
+    if err := srv.Serve("127.0.0.1:0", nil); err != nil {
+        t.Fatal(err)
+    }
+    defer srv.Fini()
+    addr := srv.Addr().String()
+
+    //同一端口同时接受不同序列化方式的调用
+    for _, styp := range []codec.SerializeType{codec.SerializeTypeMsgpack, codec.SerializeTypeJson, serializeTypeGob} {
+        cli, err := client.Dial(addr, client.WithDialSerialize(styp))
+        if err != nil {
+            t.Fatal(err)
+        }
+        var reply int
+        err = cli.Call(context.Background(), "Arith.Multiply", &Args{A: 5, B: 6}, &reply)
+        cli.Close()
+        if err != nil || reply != 30 {
+            t.Fatalf("call with %v: %v %v", styp, reply, err)
+        }
+    }
+
+    //旧版本的请求不带序列化方式，使用服务端的序列化方式，并以旧版本返回
+    conn, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    s := codec.GetSerializer(DefaultMsgPack)
+    data, err := message.NewRequest(message.MsgKindDefault, 9).Pack("Arith.Multiply", &Args{A: 2, B: 9}, s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := conn.Write(data); err != nil {
+        t.Fatal(err)
+    }
+    conn.SetReadDeadline(time.Now().Add(time.Second))
+    rmsg, err := message.NewResponse(conn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var reply int
+    if err := rmsg.Unpack(s, &reply); err != nil || reply != 18 || rmsg.Seqno() != 9 {
+        t.Fatalf("legacy call: %v %v", reply, err)
+    }
+    if rmsg.SerializeType() != codec.SerializeTypeNone {
+        t.Fatalf("legacy call replied with styp %v", rmsg.SerializeType())
+    }
+}
+
+func TestCompress(t *testing.T) {
+    srv := New("zone1001", 1, WithCompressThreshold(1))
+    if err := srv.Handle(new(Arith), "Arith"); err != nil {
+        t.Fatal(err)
+    }
+    if err := srv.Serve("127.0.0.1:0", nil); err != nil {
+        t.Fatal(err)
+    }
+    defer srv.Fini()
+    addr := srv.Addr().String()
+
+    for _, kind := range []compress.Kind{compress.None, compress.Gzip, compress.Snappy, compress.LZ4, compress.Zstd} {
+        cli, err := client.Dial(addr, client.WithDialCompress(kind, 1))
+        if err != nil {
+            t.Fatal(err)
+        }
+        var reply int
+        err = cli.Call(context.Background(), "Arith.Multiply", &Args{A: 3, B: 4}, &reply)
+        cli.Close()
+        if err != nil || reply != 12 {
+            t.Fatalf("call with %v: %v %v", kind, reply, err)
+        }
+    }
+
+    conn, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    s := codec.GetSerializer(DefaultMsgPack)
+    newRequest := func(seq uint16) *message.Message {
+        msg := message.NewRequest(message.MsgKindDefault, seq)
+        msg.SetSerializeType(DefaultMsgPack)
+        msg.SetCompress(compress.None, 0)
+        msg.SetAcceptCompress(compress.Snappy)
+        return msg
+    }
+
+    //按请求指定的方式压缩返回
+    if err = newRequest(1).PackTo(conn, "Arith.Multiply", &Args{A: 2, B: 9}, s); err != nil {
+        t.Fatal(err)
+    }
+    conn.SetReadDeadline(time.Now().Add(time.Second))
+    rmsg, err := message.NewResponse(conn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var reply int
+    if err := rmsg.Unpack(s, &reply); err != nil || reply != 18 {
+        t.Fatalf("snappy reply: %v %v", reply, err)
+    }
+    if rmsg.CompressKind() != compress.Snappy {
+        t.Fatalf("reply compressed with %v", rmsg.CompressKind())
+    }
+
+    //服务端不支持的压缩方式返回明确的错误，连接继续可用
+    data, err := newRequest(2).Pack("Arith.Multiply", &Args{A: 2, B: 9}, s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    data[5] |= 7 << 3
+    if _, err = conn.Write(data); err != nil {
+        t.Fatal(err)
+    }
+    rmsg, err = message.NewResponse(conn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    code, errmsg := rmsg.RPCError()
+    if code != message.ErrCodeServer || rmsg.Seqno() != 2 || !strings.Contains(errmsg, "unsupported") {
+        t.Fatalf("unexpected reply %v %q", code, errmsg)
+    }
+    if err = newRequest(3).PackTo(conn, "Arith.Multiply", &Args{A: 3, B: 9}, s); err != nil {
+        t.Fatal(err)
+    }
+    rmsg, err = message.NewResponse(conn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := rmsg.Unpack(s, &reply); err != nil || reply != 27 {
+        t.Fatalf("call after unsupported compress: %v %v", reply, err)
+    }
+}
+
+func TestProtocolErrors(t *testing.T) {
+    srv := New("zone1001", 1, WithMaxProtocolErrors(2), WithMaxMethodLen(16))
+    if err := srv.Handle(new(Arith), "Arith"); err != nil {
+        t.Fatal(err)
+    }
+    if err := srv.Serve("127.0.0.1:0", nil); err != nil {
+        t.Fatal(err)
+    }
+    defer srv.Fini()
+    addr := srv.Addr().String()
+    s := codec.GetSerializer(DefaultMsgPack)
+    newRequest := func(seq uint16) *message.Message {
+        msg := message.NewRequest(message.MsgKindDefault, seq)
+        msg.SetSerializeType(DefaultMsgPack)
+        return msg
+    }
+    call := func(conn net.Conn, seq uint16, method string) *message.Message {
+        if err := newRequest(seq).PackTo(conn, method, &Args{A: 2, B: 3}, s); err != nil {
+            t.Fatal(err)
+        }
+        rmsg, err := message.NewResponse(conn)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if rmsg.Seqno() != seq {
+            t.Fatalf("unexpected seqno %v, expect %v", rmsg.Seqno(), seq)
+        }
+        return rmsg
+    }
+
+    //找不到方法不算协议错误，连接上的后续调用正常
+    conn, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    conn.SetReadDeadline(time.Now().Add(time.Second))
+    for seq := uint16(1); seq <= 5; seq++ {
+        if code, _ := call(conn, seq, "Arith.Unknown").RPCError(); code != message.ErrCodeServer {
+            t.Fatalf("unexpected reply %v", code)
+        }
+    }
+    rmsg := call(conn, 6, "Arith.Multiply")
+    var reply int
+    if code, _ := rmsg.RPCError(); code != 0 {
+        t.Fatalf("unexpected reply %v", code)
+    }
+    if err = rmsg.Unpack(s, &reply); err != nil || reply != 6 {
+        t.Fatalf("unexpected reply %v, err %v", reply, err)
+    }
+    if n := srv.ProtocolErrors(); n != 0 {
+        t.Fatalf("unexpected protocol errors %v", n)
+    }
+
+    //非法的包返回错误，超过上限后断开连接
+    conn1, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn1.Close()
+    conn1.SetReadDeadline(time.Now().Add(time.Second))
+    //心跳被忽略，不影响后续请求
+    heartbeat := message.NewRequest(message.MsgKindHeartbeat, 0)
+    heartbeat.SetSerializeType(DefaultMsgPack)
+    if err = heartbeat.PackTo(conn1, "", 0, s); err != nil {
+        t.Fatal(err)
+    }
+    for seq := uint16(1); seq <= 3; seq++ {
+        if code, _ := call(conn1, seq, "Arith.MultiplyTooLong").RPCError(); code != message.ErrCodeServer {
+            t.Fatalf("unexpected reply %v", code)
+        }
+    }
+    if _, err = message.NewResponse(conn1); err != io.EOF {
+        t.Fatalf("conn not closed after too many protocol errors: %v", err)
+    }
+    if n := srv.ProtocolErrors(); n != 3 {
+        t.Fatalf("unexpected protocol errors %v", n)
+    }
+
+    //包头非法直接断开
+    conn2, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn2.Close()
+    conn2.SetReadDeadline(time.Now().Add(time.Second))
+    if _, err = conn2.Write([]byte("GET / HTTP/1.1\r\n\r\n")); err != nil {
+        t.Fatal(err)
+    }
+    if _, err = message.NewResponse(conn2); err != io.EOF {
+        t.Fatalf("conn not closed after bad frame: %v", err)
+    }
+    if n := srv.ProtocolErrors(); n != 4 {
+        t.Fatalf("unexpected protocol errors %v", n)
+    }
+}
+
+//超过统计窗口后重新计数，偶发的非法包不会累积到断开连接
+func TestProtocolErrorWindow(t *testing.T) {
+    srv := New("zone1001", 1, WithMaxProtocolErrors(2))
+    var errs protocolErrors
+    for i := 0; i < 2; i++ {
+        if !srv.protocolError(nil, &errs) {
+            t.Fatal("conn closed before reaching limit")
+        }
+    }
+    errs.since = errs.since.Add(-ProtocolErrorWindow - time.Second)
+    if !srv.protocolError(nil, &errs) || errs.count != 1 {
+        t.Fatalf("protocol errors not reset after window: %v", errs.count)
+    }
+    for i := 0; i < 2; i++ {
+        srv.protocolError(nil, &errs)
+    }
+    if srv.protocolError(nil, &errs) {
+        t.Fatal("conn not closed after too many protocol errors in window")
+    }
+}
@@ -0,0 +1,101 @@
+package transport
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "sync"
+    "time"
+)
+
+var ErrPipeClosed = errors.New("pipe listener closed")
+
+type pipeAddr string
+
+func (pa pipeAddr) Network() string { return SchemePipe }
+func (pa pipeAddr) String() string  { return string(pa) }
+
+//基于net.Pipe的进程内传输，按名字监听和连接
+type pipeTransport struct {
+    lock      sync.Mutex //protect listeners
+    listeners map[string]*pipeListener
+}
+
+func newPipeTransport() *pipeTransport {
+    return &pipeTransport{listeners: make(map[string]*pipeListener)}
+}
+
+func (pt *pipeTransport) Listen(address string) (net.Listener, error) {
+    if address == "" {
+        return nil, errors.New("empty pipe name")
+    }
+    pt.lock.Lock()
+    defer pt.lock.Unlock()
+    if _, exist := pt.listeners[address]; exist {
+        return nil, fmt.Errorf("pipe %v already in use", address)
+    }
+    pl := &pipeListener{
+        transport: pt,
+        addr:      pipeAddr(address),
+        conns:     make(chan net.Conn),
+        done:      make(chan struct{}),
+    }
+    pt.listeners[address] = pl
+    return pl, nil
+}
+
+func (pt *pipeTransport) Dial(address string, timeout time.Duration) (net.Conn, error) {
+    pt.lock.Lock()
+    pl := pt.listeners[address]
+    pt.lock.Unlock()
+    if pl == nil {
+        return nil, fmt.Errorf("dial pipe %v: no listener", address)
+    }
+
+    timer := time.NewTimer(timeout)
+    defer timer.Stop()
+    client, server := net.Pipe()
+    select {
+    case pl.conns <- server:
+        return client, nil
+    case <-pl.done:
+        client.Close()
+        server.Close()
+        return nil, fmt.Errorf("dial pipe %v: %v", address, ErrPipeClosed)
+    case <-timer.C:
+        client.Close()
+        server.Close()
+        return nil, fmt.Errorf("dial pipe %v: timeout", address)
+    }
+}
+
+type pipeListener struct {
+    transport *pipeTransport
+    addr      pipeAddr
+    conns     chan net.Conn
+    once      sync.Once
+    done      chan struct{}
+}
+
+func (pl *pipeListener) Accept() (net.Conn, error) {
+    select {
+    case conn := <-pl.conns:
+        return conn, nil
+    case <-pl.done:
+        return nil, ErrPipeClosed
+    }
+}
+
+func (pl *pipeListener) Close() error {
+    pl.once.Do(func() {
+        close(pl.done)
+        pl.transport.lock.Lock()
+        delete(pl.transport.listeners, string(pl.addr))
+        pl.transport.lock.Unlock()
+    })
+    return nil
+}
+
+func (pl *pipeListener) Addr() net.Addr {
+    return pl.addr
+}
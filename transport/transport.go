@@ -0,0 +1,129 @@
+package transport
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    SchemeTCP  = "tcp"
+    SchemeUnix = "unix"  //同机进程间通信，如 unix:///var/run/prpc.sock
+    SchemePipe = "pipe"  //进程内通信，用于测试和benchmark，如 pipe://arith
+
+    schemeSep = "://"
+)
+
+//传输层，负责监听和建立连接
+type Transport interface {
+    Listen(address string) (net.Listener, error)
+    Dial(address string, timeout time.Duration) (net.Conn, error)
+}
+
+var (
+    lock       sync.RWMutex
+    transports = map[string]Transport{
+        SchemeTCP:  &netTransport{network: "tcp"},
+        SchemeUnix: &netTransport{network: "unix"},
+        SchemePipe: newPipeTransport(),
+    }
+)
+
+//注册自定义传输层，scheme不能重复
+func Register(scheme string, t Transport) error {
+    if scheme == "" || strings.Contains(scheme, schemeSep) {
+        return fmt.Errorf("invalid transport scheme %q", scheme)
+    }
+    if t == nil {
+        return errors.New("nil transport")
+    }
+    lock.Lock()
+    defer lock.Unlock()
+    if _, exist := transports[scheme]; exist {
+        return fmt.Errorf("transport %q already registered", scheme)
+    }
+    transports[scheme] = t
+    return nil
+}
+
+//拆分地址，没有scheme的地址为tcp地址
+func Split(addr string) (scheme, address string) {
+    addr = strings.TrimSpace(addr)
+    if i := strings.Index(addr, schemeSep); i >= 0 {
+        return addr[:i], addr[i+len(schemeSep):]
+    }
+    return SchemeTCP, addr
+}
+
+func lookup(addr string) (Transport, string, error) {
+    scheme, address := Split(addr)
+    lock.RLock()
+    t := transports[scheme]
+    lock.RUnlock()
+    if t == nil {
+        return nil, "", fmt.Errorf("unsupported transport %q in addr %v", scheme, addr)
+    }
+    return t, address, nil
+}
+
+//按地址的scheme监听
+func Listen(addr string) (net.Listener, error) {
+    t, address, err := lookup(addr)
+    if err != nil {
+        return nil, err
+    }
+    return t.Listen(address)
+}
+
+//按地址的scheme建立连接
+func Dial(addr string, timeout time.Duration) (net.Conn, error) {
+    t, address, err := lookup(addr)
+    if err != nil {
+        return nil, err
+    }
+    return t.Dial(address, timeout)
+}
+
+//带scheme的地址，用于注册到服务中心；tcp地址保持原样
+func AddrString(addr net.Addr) string {
+    switch addr.Network() {
+    case "tcp", "tcp4", "tcp6":
+        return addr.String()
+    case "unix":
+        return SchemeUnix + schemeSep + addr.String()
+    }
+    return addr.Network() + schemeSep + addr.String()
+}
+
+type netTransport struct {
+    network string
+}
+
+func (nt *netTransport) Listen(address string) (net.Listener, error) {
+    if nt.network == "unix" {
+        removeStaleSocket(address)
+    }
+    return net.Listen(nt.network, address)
+}
+
+func (nt *netTransport) Dial(address string, timeout time.Duration) (net.Conn, error) {
+    return net.DialTimeout(nt.network, address, timeout)
+}
+
+//进程异常退出时会残留socket文件，没有进程监听时删除
+func removeStaleSocket(path string) {
+    fi, err := os.Stat(path)
+    if err != nil || fi.Mode()&os.ModeSocket == 0 {
+        return
+    }
+    conn, err := net.DialTimeout("unix", path, time.Second)
+    if err == nil {
+        conn.Close()
+        return
+    }
+    os.Remove(path)
+}
@@ -0,0 +1,160 @@
+package transport
+
+import (
+    "io"
+    "io/ioutil"
+    "net"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestSplit(t *testing.T) {
+    cases := []struct {
+        addr, scheme, address string
+    }{
+        {"127.0.0.1:7881", SchemeTCP, "127.0.0.1:7881"},
+        {" tcp://127.0.0.1:7881 ", SchemeTCP, "127.0.0.1:7881"},
+        {"unix:///var/run/prpc.sock", SchemeUnix, "/var/run/prpc.sock"},
+        {"pipe://arith", SchemePipe, "arith"},
+    }
+    for _, c := range cases {
+        scheme, address := Split(c.addr)
+        if scheme != c.scheme || address != c.address {
+            t.Fatalf("split %q: got %q %q", c.addr, scheme, address)
+        }
+    }
+}
+
+//echo一次，检查监听地址和连接是否可用
+func checkEcho(t *testing.T, l net.Listener) {
+    go func() {
+        for {
+            conn, err := l.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                io.Copy(conn, conn)
+            }()
+        }
+    }()
+    conn, err := Dial(AddrString(l.Addr()), time.Second)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    if _, err := conn.Write([]byte("hello")); err != nil {
+        t.Fatal(err)
+    }
+    buf := make([]byte, 5)
+    if _, err := io.ReadFull(conn, buf); err != nil {
+        t.Fatal(err)
+    }
+    if string(buf) != "hello" {
+        t.Fatalf("unexpected echo %q", buf)
+    }
+}
+
+func TestTransports(t *testing.T) {
+    dir, err := ioutil.TempDir("", "prpc")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    sock := filepath.Join(dir, "test.sock")
+
+    for _, addr := range []string{"127.0.0.1:0", "unix://" + sock, "pipe://echo"} {
+        l, err := Listen(addr)
+        if err != nil {
+            t.Fatalf("listen on %v: %v", addr, err)
+        }
+        if addr != "127.0.0.1:0" && AddrString(l.Addr()) != addr {
+            t.Fatalf("unexpected addr %v, expect %v", AddrString(l.Addr()), addr)
+        }
+        checkEcho(t, l)
+        l.Close()
+    }
+
+    if _, err := Listen("quic://127.0.0.1:0"); err == nil {
+        t.Fatal("unknown transport accepted")
+    }
+    if _, err := Dial("pipe://echo", time.Second); err == nil {
+        t.Fatal("dial closed pipe listener")
+    }
+}
+
+func TestPipe(t *testing.T) {
+    l, err := Listen("pipe://dup")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := Listen("pipe://dup"); err == nil {
+        t.Fatal("pipe name reused")
+    }
+    //没有Accept时超时
+    if _, err := Dial("pipe://dup", 10*time.Millisecond); err == nil {
+        t.Fatal("dial without accept should time out")
+    }
+
+    //Close中断Accept
+    errc := make(chan error, 1)
+    go func() {
+        _, err := l.Accept()
+        errc <- err
+    }()
+    l.Close()
+    if err := <-errc; err != ErrPipeClosed {
+        t.Fatalf("unexpected accept error %v", err)
+    }
+    l, err = Listen("pipe://dup")
+    if err != nil {
+        t.Fatal(err)
+    }
+    l.Close()
+}
+
+func TestUnixStaleSocket(t *testing.T) {
+    dir, err := ioutil.TempDir("", "prpc")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    sock := filepath.Join(dir, "stale.sock")
+
+    //模拟进程异常退出残留的socket文件
+    ul, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    ul.SetUnlinkOnClose(false)
+    ul.Close()
+    if _, err := os.Stat(sock); err != nil {
+        t.Fatal(err)
+    }
+
+    l, err := Listen("unix://" + sock)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    //已有进程监听时不删除
+    if _, err := Listen("unix://" + sock); err == nil {
+        t.Fatal("socket in use removed")
+    }
+    checkEcho(t, l)
+}
+
+func TestRegister(t *testing.T) {
+    if err := Register(SchemeTCP, &netTransport{network: "tcp"}); err == nil {
+        t.Fatal("duplicated transport registered")
+    }
+    if err := Register("", &netTransport{network: "tcp"}); err == nil {
+        t.Fatal("empty scheme registered")
+    }
+    if err := Register("tcp6", nil); err == nil {
+        t.Fatal("nil transport registered")
+    }
+}